@@ -6,6 +6,7 @@ import (
 	"errors"
 	"log/slog"
 	"os"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"gitlab.com/linkinlog/cloudKV/frontend"
@@ -15,11 +16,35 @@ import (
 type ConfigFile struct {
 	Logger   string `json:"logger"`
 	Frontend string `json:"frontend"`
+	// Retention is how long events stay in the log before compaction, which
+	// is as far back as restores and lookups can go. Unset is
+	// defaultRetention, "0s" compacts them all.
+	Retention logger.Duration `json:"retention"`
+
+	File     logger.FileOptions     `json:"file"`
+	PSQL     logger.PostgresOptions `json:"psql"`
+	Embedded logger.EmbeddedOptions `json:"embedded"`
+	Tee      logger.TeeOptions      `json:"tee"`
+
+	Encryption logger.EncryptionOptions `json:"encryption"`
+}
+
+func (c *ConfigFile) LoggerOptions() logger.Options {
+	return logger.Options{
+		File:       c.File,
+		PSQL:       c.PSQL,
+		Embedded:   c.Embedded,
+		Tee:        c.Tee,
+		Encryption: c.Encryption,
+	}
 }
 
+const defaultRetention = logger.Duration(24 * time.Hour)
+
 var defaultConfig = ConfigFile{
-	Logger:   "File",
-	Frontend: "REST",
+	Logger:    "File",
+	Frontend:  "REST",
+	Retention: defaultRetention,
 }
 
 func watchFile(configPath string, s *Service, sl *slog.Logger) (<-chan error, context.CancelFunc) {
@@ -49,7 +74,7 @@ func watchFile(configPath string, s *Service, sl *slog.Logger) (<-chan error, co
 					s.Stop()
 
 					lt := logger.ToLoggerType(conf.Logger)
-					l, err := logger.New(lt)
+					l, err := logger.New(lt, conf.LoggerOptions())
 					if err != nil {
 						errs <- err
 						return
@@ -59,6 +84,7 @@ func watchFile(configPath string, s *Service, sl *slog.Logger) (<-chan error, co
 					ft := frontend.ToFrontendType(conf.Frontend)
 					f := frontend.New(l, ft)
 					s.SwitchFrontend(f)
+					s.SetRetention(time.Duration(conf.Retention))
 
 					sl.Info("config change detected, reloading", "logger", lt.String(), "frontend", ft.String())
 					go s.Start()
@@ -92,7 +118,9 @@ func GetConfig(configPath string) (*ConfigFile, error) {
 		return nil, err
 	}
 
-	conf := &ConfigFile{}
+	// Configs from before retention existed keep the default, only an
+	// explicit setting compacts everything.
+	conf := &ConfigFile{Retention: defaultRetention}
 	if err := json.Unmarshal(file, conf); err != nil {
 		return nil, err
 	}
@@ -20,6 +20,21 @@ func FrontendPort() string {
 	)
 }
 
+// AdminAddr is where the frontend serves its admin routes and RPCs, such as
+// restores and key history, which aren't meant for every client that can
+// reach the API. They aren't served at all unless it is set, to something
+// like 127.0.0.1:8009.
+func AdminAddr() string {
+	return lookupWithFallback("ADMIN_ADDR", "")
+}
+
+// PrincipalHeader names the header, or gRPC metadata key, a proxy in front
+// of the service puts the authenticated client in. It is unset by default,
+// as anyone could set it on a request that doesn't go through such a proxy.
+func PrincipalHeader() string {
+	return lookupWithFallback("PRINCIPAL_HEADER", "")
+}
+
 func ConfigPath() string {
 	return lookupWithFallback("CONFIG_PATH", "/app/kvs")
 }
@@ -0,0 +1,30 @@
+package grpc
+
+import (
+	context "context"
+
+	"gitlab.com/linkinlog/cloudKV/logger"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// healthServer answers the standard gRPC health checks the way /healthz does
+// for REST: serving while the logger keeps up, not serving while it is
+// degraded. Watch isn't implemented, clients poll Check.
+type healthServer struct {
+	grpc_health_v1.UnimplementedHealthServer
+	l logger.Logger
+}
+
+func (h healthServer) Check(ctx context.Context, req *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
+	if req.Service != "" && req.Service != KeyValue_ServiceDesc.ServiceName {
+		return nil, status.Errorf(codes.NotFound, "unknown service %q", req.Service)
+	}
+
+	resp := &grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}
+	if h.l.Health() != nil {
+		resp.Status = grpc_health_v1.HealthCheckResponse_NOT_SERVING
+	}
+	return resp, nil
+}
@@ -0,0 +1,89 @@
+package grpc
+
+import (
+	context "context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+
+	"gitlab.com/linkinlog/cloudKV/env"
+	"gitlab.com/linkinlog/cloudKV/store"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// requestIDKey carries the request ID both ways, in metadata and headers.
+// Clients may pick their own, anything else gets one made up.
+const requestIDKey = "x-request-id"
+
+// MaxRequestID keeps clients from stuffing the log through request IDs.
+const MaxRequestID = 128
+
+type requestIDCtxKey struct{}
+
+// withRequestID gives every unary call an ID and hands it back in the
+// response headers.
+func withRequestID(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	var id string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get(requestIDKey); len(ids) > 0 {
+			id = ids[0]
+		}
+	}
+	if !ValidRequestID(id) {
+		id = NewRequestID()
+	}
+
+	_ = grpc.SetHeader(ctx, metadata.Pairs(requestIDKey, id))
+
+	return handler(context.WithValue(ctx, requestIDCtxKey{}, id), req)
+}
+
+// origin describes the call ctx belongs to for the events it logs. The
+// principal is the subject of a verified client certificate, or else what a
+// trusted proxy put in the env.PrincipalHeader metadata. The server doesn't
+// serve TLS itself, so without such a proxy there is none.
+func origin(ctx context.Context) store.Origin {
+	o := store.Origin{Frontend: "GRPC"}
+	o.RequestID, _ = ctx.Value(requestIDCtxKey{}).(string)
+
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.VerifiedChains) > 0 {
+			o.Principal = info.State.VerifiedChains[0][0].Subject.String()
+			return o
+		}
+	}
+
+	if h := env.PrincipalHeader(); h != "" {
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			if ps := md.Get(strings.ToLower(h)); len(ps) > 0 {
+				o.Principal = ps[0]
+			}
+		}
+	}
+
+	return o
+}
+
+// ValidRequestID reports whether a client's request ID is printable ASCII
+// and short enough to log.
+func ValidRequestID(id string) bool {
+	if id == "" || len(id) > MaxRequestID {
+		return false
+	}
+	for _, c := range []byte(id) {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// NewRequestID makes up a random request ID.
+func NewRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
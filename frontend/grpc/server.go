@@ -4,13 +4,19 @@ import (
 	context "context"
 	"errors"
 	"fmt"
+	"math"
 	"net"
+	"strings"
+	"time"
 
 	"gitlab.com/linkinlog/cloudKV/env"
 	"gitlab.com/linkinlog/cloudKV/logger"
 	"gitlab.com/linkinlog/cloudKV/store"
 	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
 )
 
 func NewGRPCServer(l logger.Logger) *GRPCServer {
@@ -29,18 +35,26 @@ type GRPCServer struct {
 
 	grpcServer *grpc.Server
 	listener   net.Listener
+	// admin serves every RPC, History included, on a listener of its own. It
+	// is nil unless env.AdminAddr is set.
+	admin *grpc.Server
+
+	// closing is done once Close is called, so watches, which would otherwise
+	// hold up GracefulStop forever, end.
+	closing context.Context
+	cancel  context.CancelFunc
 }
 
 func (s *GRPCServer) Start(kv *store.KeyValueStore) <-chan error {
 	s.kv = kv
 	s.err = make(chan error)
+	s.closing, s.cancel = context.WithCancel(context.Background())
 
-	gs := grpc.NewServer(
-		grpc.StatsHandler(otelgrpc.NewServerHandler()),
-	)
+	gs := newServer()
 	s.grpcServer = gs
 
-	RegisterKeyValueServer(gs, s)
+	RegisterKeyValueServer(gs, publicServer{s})
+	grpc_health_v1.RegisterHealthServer(gs, healthServer{l: s.l})
 
 	go func() {
 		lis, err := net.Listen("tcp", env.FrontendPort())
@@ -57,6 +71,26 @@ func (s *GRPCServer) Start(kv *store.KeyValueStore) <-chan error {
 		}
 	}()
 
+	if addr := env.AdminAddr(); addr != "" {
+		as := newServer()
+		s.admin = as
+
+		RegisterKeyValueServer(as, s)
+		grpc_health_v1.RegisterHealthServer(as, healthServer{l: s.l})
+
+		go func() {
+			lis, err := net.Listen("tcp", addr)
+			if err != nil {
+				s.err <- fmt.Errorf("(GRPC) admin can't hear shit! %w", err)
+				return
+			}
+
+			if err := as.Serve(lis); err != nil {
+				s.err <- fmt.Errorf("(GRPC) admin failed to serve game! %w", err)
+			}
+		}()
+	}
+
 	return s.err
 }
 
@@ -67,38 +101,319 @@ func (s *GRPCServer) Close(ctx context.Context) error {
 	if err := s.listener.Close(); err != nil {
 		return err
 	}
+	s.cancel()
 
-	s.grpcServer.GracefulStop()
+	if s.admin != nil {
+		stop(ctx, s.admin)
+	}
+	stop(ctx, s.grpcServer)
 	return nil
 }
 
+func newServer() *grpc.Server {
+	return grpc.NewServer(
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		grpc.UnaryInterceptor(withRequestID),
+	)
+}
+
+// stop stops gs gracefully, cutting off calls still going once ctx is done.
+func stop(ctx context.Context, gs *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		gs.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		gs.Stop()
+		<-stopped
+	}
+}
+
+// publicServer is what clients on the public port get. Key history holds
+// every value a key had and who wrote it, so like the REST admin routes it
+// is only served on env.AdminAddr.
+type publicServer struct {
+	*GRPCServer
+}
+
+func (publicServer) History(context.Context, *HistoryRequest) (*HistoryResponse, error) {
+	return nil, status.Error(codes.PermissionDenied, "History is only served on the admin address")
+}
+
+// maxTTLSeconds is the longest TTL a time.Duration holds, about 292 years.
+const maxTTLSeconds = int64(math.MaxInt64 / time.Second)
+
+// expiry returns when a key given ttlSeconds expires, zero if it doesn't.
+func expiry(ttlSeconds int64) (time.Time, error) {
+	if ttlSeconds < 0 || ttlSeconds > maxTTLSeconds {
+		return time.Time{}, status.Errorf(codes.InvalidArgument, "invalid ttl, want 0 to %d seconds", maxTTLSeconds)
+	}
+	if ttlSeconds == 0 {
+		return time.Time{}, nil
+	}
+	return time.Now().Add(time.Duration(ttlSeconds) * time.Second), nil
+}
+
 func (s *GRPCServer) Get(ctx context.Context, gr *GetRequest) (*GetResponse, error) {
-	val, err := s.kv.Get(gr.Key)
+	item, err := s.kv.Lookup(gr.Key)
 	if err != nil {
 		return nil, err
 	}
-	return &GetResponse{Value: val}, nil
+	return &GetResponse{Value: item.Value, Version: item.Version, ContentType: item.ContentType}, nil
 }
 
 func (s *GRPCServer) Put(ctx context.Context, pr *PutRequest) (*PutResponse, error) {
-	err := s.kv.Put(pr.Key, pr.Value)
+	expires, err := expiry(pr.TtlSeconds)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := s.l.LogPut(pr.Key, pr.Value); err != nil {
+	version, err := s.kv.Put(pr.Key, pr.Value, store.WithExpiry(expires), store.WithContentType(pr.ContentType))
+	if err != nil {
+		return nil, err
+	}
+
+	e := store.Event{
+		EventType:   store.EventPut,
+		Key:         pr.Key,
+		Value:       pr.Value,
+		ContentType: pr.ContentType,
+		Expires:     expires,
+		Version:     version,
+		Origin:      origin(ctx),
+	}
+	if err := s.l.LogBatch([]store.Event{e}); err != nil {
 		return nil, err
 	}
 
 	return &PutResponse{Key: pr.Key, Value: pr.Value}, nil
 }
 
+func (s *GRPCServer) CompareAndSwap(ctx context.Context, cr *CompareAndSwapRequest) (*CompareAndSwapResponse, error) {
+	expires, err := expiry(cr.TtlSeconds)
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := s.kv.CompareAndSwap(
+		cr.Key, cr.ExpectedVersion, cr.Value,
+		store.WithExpiry(expires), store.WithContentType(cr.ContentType),
+	)
+	if errors.Is(err, store.ErrVersionConflict) {
+		return nil, status.Errorf(codes.Aborted, "%s: key is at version %d", err, version)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	e := store.Event{
+		EventType:   store.EventPut,
+		Key:         cr.Key,
+		Value:       cr.Value,
+		ContentType: cr.ContentType,
+		Expires:     expires,
+		Version:     version,
+		Origin:      origin(ctx),
+	}
+	if err := s.l.LogBatch([]store.Event{e}); err != nil {
+		return nil, err
+	}
+
+	return &CompareAndSwapResponse{Key: cr.Key, Value: cr.Value, Version: version}, nil
+}
+
+func (s *GRPCServer) Scan(sr *ScanRequest, stream grpc.ServerStreamingServer[ScanResponse]) error {
+	if sr.Limit < 0 {
+		return errors.New("invalid limit")
+	}
+
+	start, end := sr.Start, sr.End
+	if sr.Prefix != "" {
+		start = max(start, sr.Prefix)
+		if pe := store.PrefixEnd(sr.Prefix); pe != "" && (end == "" || pe < end) {
+			end = pe
+		}
+	}
+
+	page, next := s.kv.Scan(start, end, int(sr.Limit))
+	for i, kv := range page {
+		resp := &ScanResponse{
+			Key:         kv.Key,
+			Value:       kv.Value,
+			Version:     kv.Version,
+			ContentType: kv.ContentType,
+		}
+		if i == len(page)-1 {
+			resp.Next = next
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *GRPCServer) Txn(ctx context.Context, tr *TxnRequest) (*TxnResponse, error) {
+	guards := make([]store.Guard, 0, len(tr.Guards))
+	for _, g := range tr.Guards {
+		if g.Key == "" {
+			return nil, status.Error(codes.InvalidArgument, "invalid key")
+		}
+		guards = append(guards, store.Guard{Key: g.Key, Version: g.Version})
+	}
+
+	o := origin(ctx)
+
+	ops := make([]store.Event, 0, len(tr.Ops))
+	for _, op := range tr.Ops {
+		if op.Key == "" {
+			return nil, status.Error(codes.InvalidArgument, "invalid key")
+		}
+
+		switch op.Type {
+		case TxnOp_PUT:
+			expires, err := expiry(op.TtlSeconds)
+			if err != nil {
+				return nil, err
+			}
+
+			e := store.Event{
+				EventType:   store.EventPut,
+				Key:         op.Key,
+				Value:       op.Value,
+				ContentType: op.ContentType,
+				Expires:     expires,
+				Origin:      o,
+			}
+			ops = append(ops, e)
+		case TxnOp_DELETE:
+			ops = append(ops, store.Event{EventType: store.EventDelete, Key: op.Key, Origin: o})
+		default:
+			return nil, fmt.Errorf("invalid op %v", op.Type)
+		}
+	}
+
+	err := s.kv.Txn(guards, ops)
+	if errors.Is(err, store.ErrVersionConflict) {
+		return nil, status.Error(codes.Aborted, err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.l.LogBatch(ops); err != nil {
+		return nil, err
+	}
+
+	return &TxnResponse{}, nil
+}
+
+func (s *GRPCServer) Watch(wr *WatchRequest, stream grpc.ServerStreamingServer[Event]) error {
+	if wr.Key != "" && wr.Prefix != "" {
+		return status.Error(codes.InvalidArgument, "set either key or prefix, not both")
+	}
+
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	defer context.AfterFunc(s.closing, cancel)()
+
+	events, errs := logger.Watch(ctx, s.l, store.Sequence(wr.FromSequence))
+	for e := range events {
+		if wr.Key != "" && e.Key != wr.Key || !strings.HasPrefix(e.Key, wr.Prefix) {
+			continue
+		}
+
+		if err := stream.Send(toEvent(e)); err != nil {
+			return err
+		}
+	}
+
+	if err := <-errs; err != nil {
+		return err
+	}
+	if s.closing.Err() != nil {
+		return status.Error(codes.Unavailable, "server is shutting down")
+	}
+	return nil
+}
+
+const (
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+)
+
+func (s *GRPCServer) History(ctx context.Context, hr *HistoryRequest) (*HistoryResponse, error) {
+	if hr.Key == "" {
+		return nil, status.Error(codes.InvalidArgument, "invalid key")
+	}
+	if hr.Limit < 0 || hr.Limit > maxHistoryLimit {
+		return nil, status.Error(codes.InvalidArgument, "invalid limit")
+	}
+
+	q := logger.HistoryQuery{
+		Key:   hr.Key,
+		After: store.Sequence(hr.AfterSequence),
+		Limit: int(hr.Limit),
+	}
+	if q.Limit == 0 {
+		q.Limit = defaultHistoryLimit
+	}
+	if hr.SinceUnixNano != 0 {
+		q.Since = time.Unix(0, hr.SinceUnixNano)
+	}
+	if hr.UntilUnixNano != 0 {
+		q.Until = time.Unix(0, hr.UntilUnixNano)
+	}
+
+	events, more, err := logger.History(s.l, q)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &HistoryResponse{Events: make([]*Event, 0, len(events))}
+	for _, e := range events {
+		resp.Events = append(resp.Events, toEvent(e))
+	}
+	if more {
+		resp.NextAfterSequence = uint64(events[len(events)-1].Sequence)
+	}
+
+	return resp, nil
+}
+
+func toEvent(e store.Event) *Event {
+	ev := &Event{
+		Sequence:    uint64(e.Sequence),
+		Type:        EventType(e.EventType),
+		Key:         e.Key,
+		Value:       e.Value,
+		ContentType: e.ContentType,
+		Frontend:    e.Frontend,
+		Principal:   e.Principal,
+		RequestId:   e.RequestID,
+	}
+	if !e.Expires.IsZero() {
+		ev.ExpiresUnixNano = e.Expires.UnixNano()
+	}
+	if !e.Timestamp.IsZero() {
+		ev.LoggedUnixNano = e.Timestamp.UnixNano()
+	}
+	return ev
+}
+
 func (s *GRPCServer) Delete(ctx context.Context, dr *DeleteRequest) (*DeleteResponse, error) {
-	if err := s.kv.Delete(dr.Key); err != nil {
+	version, err := s.kv.Delete(dr.Key)
+	if err != nil {
 		return nil, err
 	}
 
-	if err := s.l.LogDelete(dr.Key); err != nil {
+	e := store.Event{EventType: store.EventDelete, Key: dr.Key, Version: version, Origin: origin(ctx)}
+	if err := s.l.LogBatch([]store.Event{e}); err != nil {
 		return nil, err
 	}
 
@@ -0,0 +1,47 @@
+package frontend
+
+import (
+	"context"
+	"net/http"
+
+	"gitlab.com/linkinlog/cloudKV/env"
+	"gitlab.com/linkinlog/cloudKV/frontend/grpc"
+	"gitlab.com/linkinlog/cloudKV/store"
+)
+
+// requestIDHeader carries the request ID both ways. Clients may pick their
+// own, anything else gets one made up.
+const requestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// withRequestID gives every request an ID and hands it back in the response.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !grpc.ValidRequestID(id) {
+			id = grpc.NewRequestID()
+		}
+
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// origin describes r for the events it logs. The principal is the subject
+// of a verified client certificate, or else what a trusted proxy put in the
+// env.PrincipalHeader header. The server doesn't serve TLS itself, so without
+// such a proxy there is none.
+func origin(r *http.Request) store.Origin {
+	o := store.Origin{Frontend: REST.String()}
+	o.RequestID, _ = r.Context().Value(requestIDKey{}).(string)
+
+	switch h := env.PrincipalHeader(); {
+	case r.TLS != nil && len(r.TLS.VerifiedChains) > 0:
+		o.Principal = r.TLS.VerifiedChains[0][0].Subject.String()
+	case h != "":
+		o.Principal = r.Header.Get(h)
+	}
+
+	return o
+}
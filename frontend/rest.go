@@ -2,12 +2,22 @@ package frontend
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"mime"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"gitlab.com/linkinlog/cloudKV/env"
 	"gitlab.com/linkinlog/cloudKV/featureflags"
+	"gitlab.com/linkinlog/cloudKV/history"
 	"gitlab.com/linkinlog/cloudKV/logger"
 	"gitlab.com/linkinlog/cloudKV/store"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
@@ -23,6 +33,13 @@ func NewRESTServer(l logger.Logger) *RESTServer {
 type RESTServer struct {
 	l logger.Logger
 	s *http.Server
+	// admin serves the admin routes on a listener of their own, it is nil
+	// unless env.AdminAddr is set.
+	admin *http.Server
+
+	// cancel ends long-lived requests such as watches, which would otherwise
+	// hold up Shutdown forever.
+	cancel context.CancelFunc
 
 	telemetry bool
 }
@@ -31,16 +48,24 @@ func (s *RESTServer) Start(kv *store.KeyValueStore) <-chan error {
 	mux := http.NewServeMux()
 
 	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("GET /healthz", s.health())
 
+	mux.HandleFunc("GET /api", telemetryMiddleware(s.list(kv)))
 	mux.HandleFunc("GET /api/{key}", telemetryMiddleware(s.get(kv)))
 	mux.HandleFunc("PUT /api/{key}", telemetryMiddleware(s.put(kv)))
 	mux.HandleFunc("DELETE /api/{key}", telemetryMiddleware(s.del(kv)))
+	mux.HandleFunc("POST /api/_txn", telemetryMiddleware(s.txn(kv)))
+	mux.HandleFunc("GET /api/_watch", telemetryMiddleware(s.watch()))
 
 	errs := make(chan error)
 
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+
 	server := &http.Server{
-		Addr:    env.FrontendPort(),
-		Handler: mux,
+		Addr:        env.FrontendPort(),
+		Handler:     withRequestID(mux),
+		BaseContext: func(net.Listener) context.Context { return ctx },
 	}
 	s.s = server
 
@@ -50,6 +75,26 @@ func (s *RESTServer) Start(kv *store.KeyValueStore) <-chan error {
 		}
 	}()
 
+	if addr := env.AdminAddr(); addr != "" {
+		admin := http.NewServeMux()
+
+		admin.HandleFunc("POST /admin/restore", telemetryMiddleware(s.restore(kv)))
+		admin.HandleFunc("GET /admin/get/{key}", telemetryMiddleware(s.getAt()))
+		admin.HandleFunc("GET /admin/history/{key}", telemetryMiddleware(s.history()))
+
+		s.admin = &http.Server{
+			Addr:        addr,
+			Handler:     withRequestID(admin),
+			BaseContext: func(net.Listener) context.Context { return ctx },
+		}
+
+		go func() {
+			if err := s.admin.ListenAndServe(); err != nil {
+				errs <- fmt.Errorf("(REST) admin can't hear shit! %w", err)
+			}
+		}()
+	}
+
 	return errs
 }
 
@@ -57,7 +102,13 @@ func (s *RESTServer) Close(ctx context.Context) error {
 	if s.s == nil {
 		return nil
 	}
-	return s.s.Shutdown(ctx)
+	s.cancel()
+
+	var adminErr error
+	if s.admin != nil {
+		adminErr = s.admin.Shutdown(ctx)
+	}
+	return errors.Join(s.s.Shutdown(ctx), adminErr)
 }
 
 func telemetryMiddleware(next http.Handler) http.HandlerFunc {
@@ -82,7 +133,7 @@ func (s *RESTServer) get(kv *store.KeyValueStore) http.HandlerFunc {
 			return
 		}
 
-		val, err := kv.Get(key)
+		item, err := kv.Lookup(key)
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			_, _ = w.Write([]byte("unable to get key"))
@@ -94,12 +145,110 @@ func (s *RESTServer) get(kv *store.KeyValueStore) http.HandlerFunc {
 			if sp := trace.SpanFromContext(ctx); sp != nil {
 				sp.SetAttributes(
 					attribute.String("key", key),
-					attribute.String("value", val),
+					attribute.String("value", string(item.Value)),
 				)
 			}
 		}
 
-		_, _ = w.Write([]byte(val))
+		w.Header().Set("ETag", etag(item.Version))
+		if item.ContentType != "" {
+			w.Header().Set("Content-Type", item.ContentType)
+		}
+		_, _ = w.Write(item.Value)
+	}
+}
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// healthResponse is the body of /healthz. gRPC clients get the same answer
+// from the standard grpc.health.v1 service.
+type healthResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// health answers 200 while the logger keeps up and 503 while it is degraded.
+func (s *RESTServer) health() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := healthResponse{Status: "ok"}
+		status := http.StatusOK
+
+		if err := s.l.Health(); err != nil {
+			resp = healthResponse{Status: "degraded", Error: err.Error()}
+			status = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// listItem values are base64 encoded, like any []byte in JSON, so binary values survive.
+type listItem struct {
+	Key         string `json:"key"`
+	Value       []byte `json:"value"`
+	ContentType string `json:"content_type,omitempty"`
+	Version     uint64 `json:"version"`
+}
+
+type listResponse struct {
+	Items []listItem `json:"items"`
+	// Cursor is passed back as ?cursor= to fetch the next page, empty on the last one.
+	Cursor string `json:"cursor,omitempty"`
+}
+
+func (s *RESTServer) list(kv *store.KeyValueStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		prefix := r.FormValue("prefix")
+
+		cursor, err := base64.RawURLEncoding.DecodeString(r.FormValue("cursor"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("invalid cursor"))
+			return
+		}
+
+		limit := defaultListLimit
+		if raw := r.FormValue("limit"); raw != "" {
+			limit, err = strconv.Atoi(raw)
+			if err != nil || limit <= 0 || limit > maxListLimit {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte("invalid limit"))
+				return
+			}
+		}
+
+		page, next := kv.ListPrefix(prefix, string(cursor), limit)
+
+		resp := listResponse{Items: make([]listItem, 0, len(page))}
+		for _, kv := range page {
+			resp.Items = append(resp.Items, listItem{
+				Key:         kv.Key,
+				Value:       kv.Value,
+				ContentType: kv.ContentType,
+				Version:     kv.Version,
+			})
+		}
+		if next != "" {
+			resp.Cursor = base64.RawURLEncoding.EncodeToString([]byte(next))
+		}
+
+		if s.telemetry {
+			ctx := r.Context()
+			if sp := trace.SpanFromContext(ctx); sp != nil {
+				sp.SetAttributes(
+					attribute.String("prefix", prefix),
+					attribute.Int("results", len(page)),
+				)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
 	}
 }
 
@@ -113,20 +262,66 @@ func (s *RESTServer) put(kv *store.KeyValueStore) http.HandlerFunc {
 			return
 		}
 
-		val := r.FormValue("value")
-		if val == "" {
+		val, contentType, err := readValue(w, r)
+		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			_, _ = w.Write([]byte("invalid value"))
 			return
 		}
 
-		if err := kv.Put(key, val); err != nil {
+		var expires time.Time
+		if raw := r.FormValue("ttl"); raw != "" {
+			ttl, err := time.ParseDuration(raw)
+			if err != nil || ttl <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte("invalid ttl"))
+				return
+			}
+			expires = time.Now().Add(ttl)
+		}
+
+		opts := []store.PutOption{store.WithExpiry(expires), store.WithContentType(contentType)}
+
+		var version uint64
+
+		switch ifMatch := r.Header.Get("If-Match"); {
+		case strings.TrimSpace(ifMatch) == "*":
+			version, err = putIfExists(kv, key, val, opts...)
+		case ifMatch != "":
+			expected, perr := parseETag(ifMatch)
+			if perr != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte("invalid If-Match"))
+				return
+			}
+			version, err = kv.CompareAndSwap(key, expected, val, opts...)
+		case r.Header.Get("If-None-Match") == "*":
+			version, err = kv.CompareAndSwap(key, 0, val, opts...)
+		default:
+			version, err = kv.Put(key, val, opts...)
+		}
+
+		if errors.Is(err, store.ErrVersionConflict) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			_, _ = w.Write([]byte("unable to set key"))
 			return
 		}
 
-		if err := s.l.LogPut(key, val); err != nil {
+		e := store.Event{
+			EventType:   store.EventPut,
+			Key:         key,
+			Value:       val,
+			ContentType: contentType,
+			Expires:     expires,
+			Version:     version,
+			Origin:      origin(r),
+		}
+		if err := s.l.LogBatch([]store.Event{e}); err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			_, _ = w.Write([]byte(err.Error()))
 			return
@@ -137,16 +332,43 @@ func (s *RESTServer) put(kv *store.KeyValueStore) http.HandlerFunc {
 			if sp := trace.SpanFromContext(ctx); sp != nil {
 				sp.SetAttributes(
 					attribute.String("key", key),
-					attribute.String("value", val),
+					attribute.String("value", string(val)),
 				)
 			}
 		}
 
+		w.Header().Set("ETag", etag(version))
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte(key))
 	}
 }
 
+// putIfExists puts key only if it has a value, the way If-Match: * asks for,
+// and fails with store.ErrVersionConflict if it doesn't.
+func putIfExists(kv *store.KeyValueStore, key string, val []byte, opts ...store.PutOption) (uint64, error) {
+	item, err := kv.Lookup(key)
+	if errors.Is(err, store.ErrNoSuchKey) {
+		return 0, fmt.Errorf("%w: key doesn't exist", store.ErrVersionConflict)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// Another write may land between looking and swapping, try again at the
+	// version it left unless it was a delete.
+	expected := item.Version
+	for {
+		version, err := kv.CompareAndSwap(key, expected, val, opts...)
+		if !errors.Is(err, store.ErrVersionConflict) {
+			return version, err
+		}
+		if version == 0 {
+			return 0, fmt.Errorf("%w: key doesn't exist", store.ErrVersionConflict)
+		}
+		expected = version
+	}
+}
+
 func (s *RESTServer) del(kv *store.KeyValueStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		key := r.PathValue("key")
@@ -157,13 +379,15 @@ func (s *RESTServer) del(kv *store.KeyValueStore) http.HandlerFunc {
 			return
 		}
 
-		if err := kv.Delete(key); err != nil {
+		version, err := kv.Delete(key)
+		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			_, _ = w.Write([]byte("unable to delete key"))
 			return
 		}
 
-		if err := s.l.LogDelete(key); err != nil {
+		e := store.Event{EventType: store.EventDelete, Key: key, Version: version, Origin: origin(r)}
+		if err := s.l.LogBatch([]store.Event{e}); err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			_, _ = w.Write([]byte(err.Error()))
 			return
@@ -181,3 +405,476 @@ func (s *RESTServer) del(kv *store.KeyValueStore) http.HandlerFunc {
 		w.WriteHeader(http.StatusOK)
 	}
 }
+
+const maxValueSize = 16 << 20
+
+// readValue takes the value from the "value" field of form posts and, for
+// requests with neither a Content-Type nor a body, of the query string, which
+// is how older clients send it. Otherwise it is the raw body. The request's
+// Content-Type is only kept for raw bodies, since for forms it describes the
+// form rather than the value.
+func readValue(w http.ResponseWriter, r *http.Request) ([]byte, string, error) {
+	contentType := r.Header.Get("Content-Type")
+
+	switch mt, _, _ := mime.ParseMediaType(contentType); mt {
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		val := r.FormValue("value")
+		if val == "" {
+			return nil, "", errors.New("empty value")
+		}
+		return []byte(val), "", nil
+	}
+
+	val, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxValueSize))
+	if err != nil {
+		return nil, "", err
+	}
+
+	if contentType == "" && len(val) == 0 {
+		// Without a Content-Type an empty body is more likely a client that
+		// hasn't moved off ?value= than an empty value.
+		val := r.URL.Query().Get("value")
+		if val == "" {
+			return nil, "", errors.New("empty value")
+		}
+		return []byte(val), "", nil
+	}
+
+	return val, contentType, nil
+}
+
+func etag(version uint64) string {
+	return strconv.Quote(strconv.FormatUint(version, 10))
+}
+
+func parseETag(s string) (uint64, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "W/")
+	return strconv.ParseUint(strings.Trim(s, `"`), 10, 64)
+}
+
+type txnGuard struct {
+	Key     string `json:"key"`
+	Version uint64 `json:"version"`
+}
+
+type txnOp struct {
+	// Op is either "put" or "delete".
+	Op  string `json:"op"`
+	Key string `json:"key"`
+	// Value is base64 encoded, like any []byte in JSON.
+	Value       []byte `json:"value,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	TTL         string `json:"ttl,omitempty"`
+}
+
+// maxTxnSize bounds a transaction's JSON, values in it are base64 encoded,
+// so it holds a little more than one maximum size value.
+const maxTxnSize = 2 * maxValueSize
+
+type txnRequest struct {
+	Guards []txnGuard `json:"guards"`
+	Ops    []txnOp    `json:"ops"`
+}
+
+func (s *RESTServer) txn(kv *store.KeyValueStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req txnRequest
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxTxnSize)).Decode(&req)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			_, _ = w.Write([]byte("transaction too large"))
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("invalid transaction"))
+			return
+		}
+
+		guards := make([]store.Guard, 0, len(req.Guards))
+		for _, g := range req.Guards {
+			if g.Key == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte("invalid key"))
+				return
+			}
+			guards = append(guards, store.Guard{Key: g.Key, Version: g.Version})
+		}
+
+		o := origin(r)
+
+		ops := make([]store.Event, 0, len(req.Ops))
+		for _, op := range req.Ops {
+			if op.Key == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte("invalid key"))
+				return
+			}
+
+			switch op.Op {
+			case "put":
+				e := store.Event{
+					EventType:   store.EventPut,
+					Key:         op.Key,
+					Value:       op.Value,
+					ContentType: op.ContentType,
+					Origin:      o,
+				}
+				if op.TTL != "" {
+					ttl, err := time.ParseDuration(op.TTL)
+					if err != nil || ttl <= 0 {
+						w.WriteHeader(http.StatusBadRequest)
+						_, _ = w.Write([]byte("invalid ttl"))
+						return
+					}
+					e.Expires = time.Now().Add(ttl)
+				}
+				ops = append(ops, e)
+			case "delete":
+				ops = append(ops, store.Event{EventType: store.EventDelete, Key: op.Key, Origin: o})
+			default:
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte("invalid op"))
+				return
+			}
+		}
+
+		if err := kv.Txn(guards, ops); err != nil {
+			if errors.Is(err, store.ErrVersionConflict) {
+				w.WriteHeader(http.StatusPreconditionFailed)
+			} else {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+
+		if err := s.l.LogBatch(ops); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+
+		if s.telemetry {
+			ctx := r.Context()
+			if sp := trace.SpanFromContext(ctx); sp != nil {
+				sp.SetAttributes(
+					attribute.Int("guards", len(guards)),
+					attribute.Int("ops", len(ops)),
+				)
+			}
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+const watchHeartbeat = 15 * time.Second
+
+type watchEvent struct {
+	Key string `json:"key"`
+	// Value is base64 encoded, like any []byte in JSON.
+	Value       []byte `json:"value,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Expires     string `json:"expires,omitempty"`
+}
+
+// watch streams puts and deletes under ?prefix= as Server-Sent Events. Each
+// event id is its log sequence, so a reconnecting client that sends
+// Last-Event-ID picks up right after the last event it saw.
+func (s *RESTServer) watch() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		prefix := r.FormValue("prefix")
+
+		var from store.Sequence
+		if raw := r.Header.Get("Last-Event-ID"); raw != "" {
+			last, err := strconv.ParseUint(raw, 10, 64)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte("invalid Last-Event-ID"))
+				return
+			}
+			from = store.Sequence(last + 1)
+		}
+
+		rc := http.NewResponseController(w)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		if s.telemetry {
+			ctx := r.Context()
+			if sp := trace.SpanFromContext(ctx); sp != nil {
+				sp.SetAttributes(
+					attribute.String("prefix", prefix),
+					attribute.Int64("from", int64(from)),
+				)
+			}
+		}
+
+		heartbeat := time.NewTicker(watchHeartbeat)
+		defer heartbeat.Stop()
+
+		events, errs := logger.Watch(r.Context(), s.l, from)
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					if err := <-errs; err != nil {
+						_, _ = fmt.Fprintf(w, "event: error\ndata: %s\n\n", err)
+						_ = rc.Flush()
+					}
+					return
+				}
+
+				if !strings.HasPrefix(e.Key, prefix) {
+					continue
+				}
+
+				name := "put"
+				if e.EventType == store.EventDelete {
+					name = "delete"
+				}
+
+				data := watchEvent{Key: e.Key, Value: e.Value, ContentType: e.ContentType}
+				if !e.Expires.IsZero() {
+					data.Expires = e.Expires.Format(time.RFC3339Nano)
+				}
+
+				payload, err := json.Marshal(data)
+				if err != nil {
+					return
+				}
+
+				if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Sequence, name, payload); err != nil {
+					return
+				}
+			case <-heartbeat.C:
+				if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+					return
+				}
+			}
+
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+type restoreResponse struct {
+	Changed int `json:"changed"`
+}
+
+// restore rolls the store back to ?to=, a log sequence or an RFC 3339 time.
+// The changes are logged like any other write, so it can be undone by
+// restoring to the sequence before it.
+func (s *RESTServer) restore(kv *store.KeyValueStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, err := history.ParsePoint(r.FormValue("to"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+
+		n, err := history.Restore(s.l, kv, p, origin(r))
+		if err != nil {
+			w.WriteHeader(historyStatus(err))
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+
+		if s.telemetry {
+			ctx := r.Context()
+			if sp := trace.SpanFromContext(ctx); sp != nil {
+				sp.SetAttributes(
+					attribute.String("to", p.String()),
+					attribute.Int("changed", n),
+				)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(restoreResponse{Changed: n})
+	}
+}
+
+// getAt answers a Get as of ?at=, a log sequence or an RFC 3339 time, from
+// the log alone. The store is left as it is.
+func (s *RESTServer) getAt() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.PathValue("key")
+
+		if key == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("invalid key"))
+			return
+		}
+
+		p, err := history.ParsePoint(r.FormValue("at"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+
+		item, err := history.Lookup(s.l, key, p)
+		if err != nil {
+			w.WriteHeader(historyStatus(err))
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+
+		if s.telemetry {
+			ctx := r.Context()
+			if sp := trace.SpanFromContext(ctx); sp != nil {
+				sp.SetAttributes(
+					attribute.String("key", key),
+					attribute.String("at", p.String()),
+				)
+			}
+		}
+
+		w.Header().Set("ETag", etag(item.Version))
+		if item.ContentType != "" {
+			w.Header().Set("Content-Type", item.ContentType)
+		}
+		_, _ = w.Write(item.Value)
+	}
+}
+
+type historyEvent struct {
+	Sequence uint64 `json:"sequence"`
+	// Op is either "put" or "delete".
+	Op string `json:"op"`
+	// Value is base64 encoded, like any []byte in JSON.
+	Value       []byte `json:"value,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Expires     string `json:"expires,omitempty"`
+	// Time is when the event was logged, empty for events from before
+	// loggers kept it.
+	Time      string `json:"time,omitempty"`
+	Frontend  string `json:"frontend,omitempty"`
+	Principal string `json:"principal,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+type historyResponse struct {
+	Events []historyEvent `json:"events"`
+	// Cursor is passed back as ?cursor= to fetch the next page, empty on the last one.
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// history lists the logged events of a key, oldest first, optionally only
+// those logged in [?since=, ?until=). Events compacted out of the log are
+// gone from it.
+func (s *RESTServer) history() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := logger.HistoryQuery{Key: r.PathValue("key"), Limit: defaultListLimit}
+
+		if q.Key == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("invalid key"))
+			return
+		}
+
+		if raw := r.FormValue("cursor"); raw != "" {
+			after, err := strconv.ParseUint(raw, 10, 64)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte("invalid cursor"))
+				return
+			}
+			q.After = store.Sequence(after)
+		}
+
+		for name, t := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+			if raw := r.FormValue(name); raw != "" {
+				parsed, err := time.Parse(time.RFC3339Nano, raw)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					_, _ = w.Write([]byte("invalid " + name))
+					return
+				}
+				*t = parsed
+			}
+		}
+
+		if raw := r.FormValue("limit"); raw != "" {
+			limit, err := strconv.Atoi(raw)
+			if err != nil || limit <= 0 || limit > maxListLimit {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte("invalid limit"))
+				return
+			}
+			q.Limit = limit
+		}
+
+		events, more, err := logger.History(s.l, q)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+
+		resp := historyResponse{Events: make([]historyEvent, 0, len(events))}
+		for _, e := range events {
+			he := historyEvent{
+				Sequence:    uint64(e.Sequence),
+				Op:          "put",
+				Value:       e.Value,
+				ContentType: e.ContentType,
+				Frontend:    e.Frontend,
+				Principal:   e.Principal,
+				RequestID:   e.RequestID,
+			}
+			if e.EventType == store.EventDelete {
+				he.Op = "delete"
+			}
+			if !e.Expires.IsZero() {
+				he.Expires = e.Expires.Format(time.RFC3339Nano)
+			}
+			if !e.Timestamp.IsZero() {
+				he.Time = e.Timestamp.Format(time.RFC3339Nano)
+			}
+			resp.Events = append(resp.Events, he)
+		}
+		if more {
+			resp.Cursor = strconv.FormatUint(uint64(events[len(events)-1].Sequence), 10)
+		}
+
+		if s.telemetry {
+			ctx := r.Context()
+			if sp := trace.SpanFromContext(ctx); sp != nil {
+				sp.SetAttributes(
+					attribute.String("key", q.Key),
+					attribute.Int("results", len(events)),
+				)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// historyStatus maps an error from the history package to a status code.
+func historyStatus(err error) int {
+	switch {
+	case errors.Is(err, store.ErrNoSuchKey):
+		return http.StatusNotFound
+	case errors.Is(err, logger.ErrCompacted):
+		return http.StatusGone
+	case errors.Is(err, history.ErrRestoreConflict):
+		return http.StatusConflict
+	case errors.Is(err, logger.ErrBatchTooLarge):
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,186 @@
+package frontend
+
+import (
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"gitlab.com/linkinlog/cloudKV/logger"
+	"gitlab.com/linkinlog/cloudKV/store"
+)
+
+// TestPutValue covers every way clients send a value, old and new.
+func TestPutValue(t *testing.T) {
+	l := logger.NewMemoryTransactionLogger()
+	l.Run()
+	defer l.Close()
+
+	s := NewRESTServer(l)
+
+	var multipartBody strings.Builder
+	mw := multipart.NewWriter(&multipartBody)
+	_ = mw.WriteField("value", "multipart")
+	_ = mw.Close()
+
+	for _, tt := range []struct {
+		name        string
+		target      string
+		contentType string
+		body        string
+
+		status     int
+		value      string
+		storedType string
+	}{
+		{
+			name:        "form",
+			target:      "/api/k",
+			contentType: "application/x-www-form-urlencoded",
+			body:        url.Values{"value": {"form"}}.Encode(),
+			status:      http.StatusOK,
+			value:       "form",
+		},
+		{
+			name:        "multipart",
+			target:      "/api/k",
+			contentType: mw.FormDataContentType(),
+			body:        multipartBody.String(),
+			status:      http.StatusOK,
+			value:       "multipart",
+		},
+		{
+			name:   "query",
+			target: "/api/k?value=hello",
+			status: http.StatusOK,
+			value:  "hello",
+		},
+		{
+			name:        "raw",
+			target:      "/api/k",
+			contentType: "application/json",
+			body:        `{"a":1}`,
+			status:      http.StatusOK,
+			value:       `{"a":1}`,
+			storedType:  "application/json",
+		},
+		{
+			name:   "raw without a content type",
+			target: "/api/k?value=ignored",
+			body:   "body",
+			status: http.StatusOK,
+			value:  "body",
+		},
+		{
+			name:        "empty raw",
+			target:      "/api/k",
+			contentType: "text/plain",
+			status:      http.StatusOK,
+			value:       "",
+			storedType:  "text/plain",
+		},
+		{
+			name:   "nothing at all",
+			target: "/api/k",
+			status: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			kv := store.New(false)
+
+			r := httptest.NewRequest(http.MethodPut, tt.target, strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			r.SetPathValue("key", "k")
+			w := httptest.NewRecorder()
+
+			s.put(kv)(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+
+			item, err := kv.Lookup("k")
+			if tt.status != http.StatusOK {
+				if err == nil {
+					t.Errorf("stored %q for a rejected request", item.Value)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(item.Value) != tt.value || item.ContentType != tt.storedType {
+				t.Errorf("stored %q as %q, want %q as %q", item.Value, item.ContentType, tt.value, tt.storedType)
+			}
+		})
+	}
+}
+
+func TestPutIfMatchAny(t *testing.T) {
+	l := logger.NewMemoryTransactionLogger()
+	l.Run()
+	defer l.Close()
+
+	s := NewRESTServer(l)
+	kv := store.New(false)
+
+	put := func(value string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPut, "/api/k?value="+value, nil)
+		r.Header.Set("If-Match", "*")
+		r.SetPathValue("key", "k")
+		w := httptest.NewRecorder()
+		s.put(kv)(w, r)
+		return w
+	}
+
+	if w := put("first"); w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("status %d putting a missing key, want %d: %s", w.Code, http.StatusPreconditionFailed, w.Body)
+	}
+	if _, err := kv.Lookup("k"); err == nil {
+		t.Fatal("If-Match: * created a key")
+	}
+
+	if _, err := kv.Put("k", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if w := put("second"); w.Code != http.StatusOK {
+		t.Fatalf("status %d putting an existing key, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if item, err := kv.Lookup("k"); err != nil || string(item.Value) != "second" {
+		t.Errorf("stored %q, %v, want %q", item.Value, err, "second")
+	}
+}
+
+func TestOriginPrincipal(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPut, "/api/k", nil)
+	r.Header.Set("X-Forwarded-User", "alice")
+
+	if o := origin(r); o.Principal != "" {
+		t.Errorf("principal %q taken from a header nobody trusted", o.Principal)
+	}
+
+	t.Setenv("PRINCIPAL_HEADER", "X-Forwarded-User")
+	if o := origin(r); o.Principal != "alice" {
+		t.Errorf("got principal %q, want %q", o.Principal, "alice")
+	}
+}
+
+func TestTxnTooLarge(t *testing.T) {
+	l := logger.NewMemoryTransactionLogger()
+	l.Run()
+	defer l.Close()
+
+	s := NewRESTServer(l)
+
+	body := `{"ops":[{"type":"put","key":"k","value":"` + strings.Repeat("A", maxTxnSize) + `"}]}`
+	w := httptest.NewRecorder()
+	s.txn(store.New(false))(w, httptest.NewRequest(http.MethodPost, "/api/_txn", strings.NewReader(body)))
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+}
@@ -0,0 +1,230 @@
+// Package history rebuilds the store as it was at any point of its
+// transaction log, for restoring it there or looking into what happened.
+package history
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"gitlab.com/linkinlog/cloudKV/logger"
+	"gitlab.com/linkinlog/cloudKV/store"
+)
+
+// Point is a place in the log: everything up to Sequence, or everything
+// logged up to Time. The zero Point is the end of the log.
+//
+// Events logged before loggers kept timestamps count as logged before any
+// Time. Should the clock ever go back, a Time ends at the first event logged
+// after it, so a Point is always a prefix of the log.
+type Point struct {
+	Sequence store.Sequence
+	Time     time.Time
+}
+
+// Latest is the end of the log.
+var Latest = Point{}
+
+// ParsePoint reads a sequence number or an RFC 3339 time.
+func ParsePoint(s string) (Point, error) {
+	if seq, err := strconv.ParseUint(s, 10, 64); err == nil && seq > 0 {
+		return Point{Sequence: store.Sequence(seq)}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return Point{}, fmt.Errorf("%q is neither a sequence nor an RFC 3339 time", s)
+	}
+
+	return Point{Time: t}, nil
+}
+
+func (p Point) String() string {
+	switch {
+	case p.Sequence > 0:
+		return fmt.Sprintf("sequence %d", p.Sequence)
+	case !p.Time.IsZero():
+		return p.Time.Format(time.RFC3339Nano)
+	}
+	return "latest"
+}
+
+// includes reports whether e was logged at or before p.
+func (p Point) includes(e store.Event) bool {
+	switch {
+	case p.Sequence > 0:
+		return e.Sequence <= p.Sequence
+	case !p.Time.IsZero():
+		return !e.Timestamp.After(p.Time)
+	}
+	return true
+}
+
+// start returns the snapshot to start from on the way to p, nil if there is
+// none. It fails with logger.ErrCompacted if p is before the snapshot.
+func start(l logger.Logger, p Point) (*store.Snapshot, error) {
+	snap, err := l.LoadSnapshot()
+	if err != nil || snap == nil {
+		return nil, err
+	}
+
+	if !p.includes(store.Event{Sequence: snap.Sequence, Timestamp: snap.Time}) {
+		return nil, fmt.Errorf("%w: the log only goes back to sequence %d", logger.ErrCompacted, snap.Sequence)
+	}
+
+	return snap, nil
+}
+
+// Replay restores the latest snapshot of l into kv and applies the events
+// logged after it, up to p. It reads the whole log either way, loggers learn
+// the last sequence from that. It returns the last event applied, which has a
+// zero Sequence if none were.
+func Replay(l logger.Logger, kv *store.KeyValueStore, p Point) (store.Event, error) {
+	snap, err := start(l, p)
+	if err != nil {
+		return store.Event{}, err
+	}
+
+	var (
+		from store.Sequence
+		last store.Event
+		r    = replayer{kv: kv}
+	)
+	if snap != nil {
+		kv.Restore(*snap)
+		from = snap.Sequence
+	}
+
+	events, errs := l.ReadEvents()
+
+	// Events the snapshot already holds are skipped.
+	done := false
+	for e := range events {
+		if done || e.Sequence <= from {
+			continue
+		}
+		if !p.includes(e) {
+			done = true
+			continue
+		}
+
+		if err := r.apply(e); err != nil {
+			// The rest of the log still has to be read for ReadEvents to finish.
+			for range events {
+			}
+			return last, err
+		}
+		last = e
+	}
+
+	return last, <-errs
+}
+
+// replayer applies events in log order, which for concurrent writes isn't
+// always the order they were made in.
+type replayer struct {
+	kv *store.KeyValueStore
+	// deleted holds the version of the latest delete of every key, so a put
+	// made before it but logged after it doesn't bring the key back.
+	deleted map[string]uint64
+}
+
+func (r *replayer) apply(e store.Event) error {
+	switch {
+	case e.Version == 0:
+	case e.EventType == store.EventDelete:
+		if r.deleted == nil {
+			r.deleted = make(map[string]uint64)
+		}
+		r.deleted[e.Key] = max(r.deleted[e.Key], e.Version)
+	case e.Version < r.deleted[e.Key]:
+		// The delete already moved the revision past it.
+		return nil
+	}
+
+	_, err := r.kv.Apply(e)
+	return err
+}
+
+// Lookup returns what key held at p, with the version it had then. A key
+// that was deleted, never written or had expired by then is
+// store.ErrNoSuchKey.
+//
+// Only the one key is followed, so it is much cheaper than replaying the
+// whole store.
+func Lookup(l logger.Logger, key string, p Point) (store.KeyValue, error) {
+	snap, err := start(l, p)
+	if err != nil {
+		return store.KeyValue{}, err
+	}
+
+	var (
+		kv      store.KeyValue
+		found   bool
+		from    store.Sequence
+		rev     uint64
+		deleted uint64
+		at      time.Time
+	)
+
+	if snap != nil {
+		from, rev, at = snap.Sequence, snap.Rev, snap.Time
+		for _, e := range snap.Entries {
+			if e.Key == key {
+				kv, found = e, true
+				break
+			}
+		}
+	}
+
+	events, errs := l.ReadEventsFrom(from + 1)
+
+	done := false
+	for e := range events {
+		if done || !p.includes(e) {
+			done = true
+			continue
+		}
+		at = e.Timestamp
+
+		// The same rules as KeyValueStore.Apply, for the one key.
+		version := e.Version
+		if version == 0 {
+			rev++
+			version = rev
+		} else {
+			rev = max(rev, version)
+		}
+
+		if e.Key != key || version <= kv.Version || version < deleted {
+			continue
+		}
+
+		switch e.EventType {
+		case store.EventPut:
+			kv = store.KeyValue{
+				Key:         key,
+				Value:       e.Value,
+				ContentType: e.ContentType,
+				Version:     version,
+				Expires:     e.Expires,
+			}
+			found = true
+		case store.EventDelete:
+			kv, found = store.KeyValue{}, false
+			deleted = max(deleted, version)
+		}
+	}
+	if err := <-errs; err != nil {
+		return store.KeyValue{}, err
+	}
+
+	if !p.Time.IsZero() {
+		at = p.Time
+	}
+	if !found || (!kv.Expires.IsZero() && !at.IsZero() && !at.Before(kv.Expires)) {
+		return store.KeyValue{}, store.ErrNoSuchKey
+	}
+
+	return kv, nil
+}
@@ -0,0 +1,228 @@
+package history_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gitlab.com/linkinlog/cloudKV/history"
+	"gitlab.com/linkinlog/cloudKV/logger"
+	"gitlab.com/linkinlog/cloudKV/store"
+)
+
+var epoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// setup logs a=1, b=1, a=2 and deletes b, a minute apart from epoch.
+func setup(t *testing.T) *logger.MemoryTransactionLogger {
+	t.Helper()
+
+	l := logger.NewMemoryTransactionLogger()
+	l.Run()
+	t.Cleanup(func() { _ = l.Close() })
+
+	for i, e := range []store.Event{
+		{EventType: store.EventPut, Key: "a", Value: []byte("1")},
+		{EventType: store.EventPut, Key: "b", Value: []byte("1")},
+		{EventType: store.EventPut, Key: "a", Value: []byte("2")},
+		{EventType: store.EventDelete, Key: "b"},
+	} {
+		e.Timestamp = epoch.Add(time.Duration(i) * time.Minute)
+		if err := l.LogBatch([]store.Event{e}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return l
+}
+
+func TestLookup(t *testing.T) {
+	l := setup(t)
+
+	for _, tt := range []struct {
+		key     string
+		at      history.Point
+		value   string
+		version uint64
+	}{
+		{"a", history.Point{Sequence: 1}, "1", 1},
+		{"a", history.Point{Sequence: 2}, "1", 1},
+		{"a", history.Latest, "2", 3},
+		{"b", history.Point{Time: epoch.Add(90 * time.Second)}, "1", 2},
+		{"b", history.Latest, "", 0},
+		{"c", history.Latest, "", 0},
+	} {
+		kv, err := history.Lookup(l, tt.key, tt.at)
+		if tt.version == 0 {
+			if !errors.Is(err, store.ErrNoSuchKey) {
+				t.Errorf("%s at %s: got %v, want ErrNoSuchKey", tt.key, tt.at, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s at %s: %v", tt.key, tt.at, err)
+		}
+		if string(kv.Value) != tt.value || kv.Version != tt.version {
+			t.Errorf("%s at %s: got %q version %d, want %q version %d",
+				tt.key, tt.at, kv.Value, kv.Version, tt.value, tt.version)
+		}
+	}
+}
+
+func TestRestore(t *testing.T) {
+	l := setup(t)
+
+	kv := store.New(false)
+	if _, err := history.Replay(l, kv, history.Latest); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := history.Restore(l, kv, history.Point{Sequence: 2}, store.Origin{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("restore changed %d keys, want 2", n)
+	}
+
+	// The restore is logged, so a replay and lookups agree with the store.
+	replayed := store.New(false)
+	if _, err := history.Replay(l, replayed, history.Latest); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b"} {
+		want, err := kv.Lookup(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(want.Value) != "1" {
+			t.Errorf("%s = %q after the restore, want 1", key, want.Value)
+		}
+
+		for name, got := range map[string]func() (store.KeyValue, error){
+			"replay": func() (store.KeyValue, error) { return replayed.Lookup(key) },
+			"lookup": func() (store.KeyValue, error) { return history.Lookup(l, key, history.Latest) },
+		} {
+			kv, err := got()
+			if err != nil {
+				t.Fatalf("%s %s: %v", name, key, err)
+			}
+			if string(kv.Value) != string(want.Value) || kv.Version != want.Version {
+				t.Errorf("%s %s: got %q version %d, want %q version %d",
+					name, key, kv.Value, kv.Version, want.Value, want.Version)
+			}
+		}
+	}
+
+	if n, err := history.Restore(l, kv, history.Point{Sequence: 2}, store.Origin{}); err != nil || n != 0 {
+		t.Errorf("restoring again changed %d keys, %v", n, err)
+	}
+}
+
+func TestRestoreTooLarge(t *testing.T) {
+	l := logger.NewMemoryTransactionLogger()
+	l.Run()
+	t.Cleanup(func() { _ = l.Close() })
+
+	kv := store.New(false)
+	value := make([]byte, 20<<20)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if err := l.LogBatch([]store.Event{{EventType: store.EventPut, Key: key, Value: value}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := history.Restore(l, kv, history.Latest, store.Origin{})
+	if !errors.Is(err, logger.ErrBatchTooLarge) {
+		t.Fatalf("Restore returned %v, want %v", err, logger.ErrBatchTooLarge)
+	}
+	if _, err := kv.Lookup("a"); !errors.Is(err, store.ErrNoSuchKey) {
+		t.Errorf("the store changed: %v", err)
+	}
+}
+
+func TestCompacted(t *testing.T) {
+	l := setup(t)
+
+	kv := store.New(false)
+	if _, err := history.Replay(l, kv, history.Point{Sequence: 2}); err != nil {
+		t.Fatal(err)
+	}
+	snap := kv.Snapshot(2)
+	snap.Time = epoch.Add(time.Minute)
+	if err := l.Compact(snap); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := history.Lookup(l, "a", history.Point{Sequence: 1}); !errors.Is(err, logger.ErrCompacted) {
+		t.Errorf("lookup before the snapshot: got %v, want ErrCompacted", err)
+	}
+	if _, err := history.Lookup(l, "a", history.Point{Time: epoch}); !errors.Is(err, logger.ErrCompacted) {
+		t.Errorf("lookup before the snapshot time: got %v, want ErrCompacted", err)
+	}
+
+	got, err := history.Lookup(l, "b", history.Point{Sequence: 3})
+	if err != nil || string(got.Value) != "1" || got.Version != 2 {
+		t.Errorf("lookup after the snapshot: got %q version %d, %v", got.Value, got.Version, err)
+	}
+}
+
+func TestReplayOutOfOrder(t *testing.T) {
+	l := logger.NewMemoryTransactionLogger()
+	l.Run()
+	t.Cleanup(func() { _ = l.Close() })
+
+	// Concurrent writers took these versions in one order and logged them in
+	// another: a=2 is overwritten by a=3, b=1 was deleted before c brought
+	// the revision to 6.
+	for _, e := range []store.Event{
+		{EventType: store.EventPut, Key: "a", Value: []byte("3"), Version: 3},
+		{EventType: store.EventPut, Key: "a", Value: []byte("2"), Version: 2},
+		{EventType: store.EventDelete, Key: "b", Version: 5},
+		{EventType: store.EventPut, Key: "b", Value: []byte("1"), Version: 4},
+		{EventType: store.EventPut, Key: "c", Value: []byte("1"), Version: 6},
+		{EventType: store.EventPut, Key: "d", Value: []byte("1"), Version: 1},
+	} {
+		if err := l.LogBatch([]store.Event{e}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	kv := store.New(false)
+	if _, err := history.Replay(l, kv, history.Latest); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		key     string
+		value   string
+		version uint64
+	}{
+		{"a", "3", 3},
+		{"b", "", 0},
+		{"c", "1", 6},
+		{"d", "1", 1},
+	} {
+		got, err := kv.Lookup(tt.key)
+		looked, lerr := history.Lookup(l, tt.key, history.Latest)
+		if tt.version == 0 {
+			if !errors.Is(err, store.ErrNoSuchKey) || !errors.Is(lerr, store.ErrNoSuchKey) {
+				t.Errorf("%s: got %v and %v, want ErrNoSuchKey", tt.key, err, lerr)
+			}
+			continue
+		}
+		if err != nil || lerr != nil {
+			t.Fatalf("%s: %v, %v", tt.key, err, lerr)
+		}
+		if string(got.Value) != tt.value || got.Version != tt.version {
+			t.Errorf("Replay %s: got %q version %d, want %q version %d", tt.key, got.Value, got.Version, tt.value, tt.version)
+		}
+		if string(looked.Value) != tt.value || looked.Version != tt.version {
+			t.Errorf("Lookup %s: got %q version %d, want %q version %d", tt.key, looked.Value, looked.Version, tt.value, tt.version)
+		}
+	}
+
+	// The next write has to go past every logged version.
+	if v, err := kv.Put("e", []byte("1")); err != nil || v != 7 {
+		t.Errorf("Put after replay: got version %d, %v, want 7", v, err)
+	}
+}
@@ -0,0 +1,112 @@
+package history
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"gitlab.com/linkinlog/cloudKV/logger"
+	"gitlab.com/linkinlog/cloudKV/store"
+)
+
+// ErrRestoreConflict is returned when writes kept racing a restore.
+var ErrRestoreConflict = errors.New("store kept changing during the restore")
+
+// restoreAttempts is how often Restore tries again when writes race it.
+const restoreAttempts = 3
+
+// Restore rolls kv back, or forward, to what it held at p. Nothing is
+// dropped from the log: the puts and deletes that get kv there are logged as
+// one batch like any other write, so the restore can be undone the same way.
+// The events carry o. It returns how many keys changed.
+//
+// The changes are applied as a transaction guarded by the versions they were
+// worked out from. Should writes race it, Restore starts over, and gives up
+// with ErrRestoreConflict after a few tries. Changes too large to log as one
+// batch fail with logger.ErrBatchTooLarge before kv is touched.
+func Restore(l logger.Logger, kv *store.KeyValueStore, p Point, o store.Origin) (int, error) {
+	past := store.New(false)
+	if _, err := Replay(l, past, p); err != nil {
+		return 0, err
+	}
+	want := past.Snapshot(0)
+
+	for range restoreAttempts {
+		guards, ops := diff(kv.Snapshot(0).Entries, want.Entries)
+		if len(ops) == 0 {
+			return 0, nil
+		}
+		for i := range ops {
+			ops[i].Origin = o
+		}
+		if err := logger.CheckBatch(ops); err != nil {
+			return 0, fmt.Errorf("can't restore %d keys at once: %w", len(ops), err)
+		}
+
+		err := kv.Txn(guards, ops)
+		if errors.Is(err, store.ErrVersionConflict) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		if err := l.LogBatch(ops); err != nil {
+			return 0, fmt.Errorf("failed to log the restore: %w", err)
+		}
+
+		return len(ops), nil
+	}
+
+	return 0, ErrRestoreConflict
+}
+
+// diff returns the ops that turn have into want, along with guards that hold
+// them back if any key they touch moved on from have. Both must be sorted
+// by key, as snapshots are.
+func diff(have, want []store.KeyValue) ([]store.Guard, []store.Event) {
+	var (
+		guards []store.Guard
+		ops    []store.Event
+	)
+
+	put := func(kv store.KeyValue, version uint64) {
+		guards = append(guards, store.Guard{Key: kv.Key, Version: version})
+		ops = append(ops, store.Event{
+			EventType:   store.EventPut,
+			Key:         kv.Key,
+			Value:       kv.Value,
+			ContentType: kv.ContentType,
+			Expires:     kv.Expires,
+		})
+	}
+	del := func(kv store.KeyValue) {
+		guards = append(guards, store.Guard{Key: kv.Key, Version: kv.Version})
+		ops = append(ops, store.Event{EventType: store.EventDelete, Key: kv.Key})
+	}
+
+	for len(have) > 0 || len(want) > 0 {
+		switch {
+		case len(want) == 0 || (len(have) > 0 && have[0].Key < want[0].Key):
+			del(have[0])
+			have = have[1:]
+		case len(have) == 0 || want[0].Key < have[0].Key:
+			put(want[0], 0)
+			want = want[1:]
+		default:
+			if !same(have[0], want[0]) {
+				put(want[0], have[0].Version)
+			}
+			have, want = have[1:], want[1:]
+		}
+	}
+
+	return guards, ops
+}
+
+func same(a, b store.KeyValue) bool {
+	return bytes.Equal(a.Value, b.Value) &&
+		strings.EqualFold(a.ContentType, b.ContentType) &&
+		a.Expires.Equal(b.Expires)
+}
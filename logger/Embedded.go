@@ -0,0 +1,395 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"gitlab.com/linkinlog/cloudKV/store"
+	bolt "go.etcd.io/bbolt"
+)
+
+// An embedded log is a bbolt database. Events are kept in eventsBucket keyed
+// by their sequence, big endian so the keys sort in order and double as an
+// index for reading from any sequence. Each value is the record payload of
+// that one event, see file_format.go, in the version kept under versionKey.
+// The latest snapshot sits in metaBucket too.
+var (
+	eventsBucket = []byte("events")
+	metaBucket   = []byte("meta")
+	snapshotKey  = []byte("snapshot")
+	versionKey   = []byte("version")
+)
+
+// embeddedVersion is the payload version of databases from before versionKey.
+const embeddedVersion = 2
+
+// readChunk is how many events a read takes per read transaction, so slow
+// readers never keep one open for long.
+const readChunk = 256
+
+type EmbeddedOptions struct {
+	// Durable makes LogPut, LogDelete and LogBatch wait until their events are
+	// committed. Every commit is synced, concurrent calls share one.
+	Durable bool `json:"durable"`
+}
+
+func NewEmbeddedTransactionLogger(filename string, opts EmbeddedOptions) (*EmbeddedTransactionLogger, error) {
+	// The timeout only matters if another process has the database open.
+	db, err := bolt.Open(filename, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	l := &EmbeddedTransactionLogger{db: db, opts: opts}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(eventsBucket); err != nil {
+			return err
+		}
+
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+
+		if err := upgradeEvents(tx); err != nil {
+			return fmt.Errorf("upgrading events: %w", err)
+		}
+
+		if b := meta.Get(snapshotKey); b != nil {
+			seq, err := parseSnapshotSequence(b)
+			if err != nil {
+				return fmt.Errorf("snapshot: %w", err)
+			}
+			l.compacted.Store(uint64(seq))
+		}
+
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to initialize database: %w", err)
+	}
+
+	return l, nil
+}
+
+type EmbeddedTransactionLogger struct {
+	feed
+	health
+
+	queue  *queue
+	errors chan error
+	db     *bolt.DB
+	opts   EmbeddedOptions
+
+	// compacted is the sequence covered by the latest snapshot.
+	compacted atomic.Uint64
+}
+
+// upgradeEvents rewrites every event in the current payload version, unless
+// they are in it already.
+func upgradeEvents(tx *bolt.Tx) error {
+	meta, b := tx.Bucket(metaBucket), tx.Bucket(eventsBucket)
+
+	version := byte(embeddedVersion)
+	if v := meta.Get(versionKey); len(v) == 1 {
+		version = v[0]
+	} else if k, _ := b.Cursor().First(); k == nil {
+		version = fileVersion
+	}
+
+	if version > fileVersion {
+		return fmt.Errorf("unsupported version %d", version)
+	}
+
+	if version < fileVersion {
+		// Writing moves the cursor, so events are read a chunk at a time and
+		// the cursor sought again after writing them.
+		var (
+			keys   [][]byte
+			values [][]byte
+			from   = sequenceKey(0)
+		)
+
+		for {
+			keys, values = keys[:0], values[:0]
+
+			c := b.Cursor()
+			for k, v := c.Seek(from); k != nil && len(keys) < readChunk; k, v = c.Next() {
+				events, err := decodeRecord(v, version)
+				if err == nil && len(events) != 1 {
+					err = errBadRecord
+				}
+				if err != nil {
+					return fmt.Errorf("event %d: %w", binary.BigEndian.Uint64(k), err)
+				}
+				keys = append(keys, bytes.Clone(k))
+				values = append(values, appendPayload(nil, events))
+			}
+
+			for i := range keys {
+				if err := b.Put(keys[i], values[i]); err != nil {
+					return err
+				}
+			}
+
+			if len(keys) < readChunk {
+				break
+			}
+			from = sequenceKey(store.Sequence(binary.BigEndian.Uint64(keys[len(keys)-1]) + 1))
+		}
+	}
+
+	return meta.Put(versionKey, []byte{fileVersion})
+}
+
+func (l *EmbeddedTransactionLogger) Close() error {
+	l.queue.close()
+	return l.db.Close()
+}
+
+func (l *EmbeddedTransactionLogger) LogPut(key string, value []byte, contentType string, expires time.Time) error {
+	return l.queue.submit([]store.Event{{
+		EventType:   store.EventPut,
+		Key:         key,
+		Value:       value,
+		ContentType: contentType,
+		Expires:     expires,
+	}}, l.opts.Durable)
+}
+
+func (l *EmbeddedTransactionLogger) LogDelete(key string) error {
+	return l.queue.submit([]store.Event{{EventType: store.EventDelete, Key: key}}, l.opts.Durable)
+}
+
+func (l *EmbeddedTransactionLogger) LogBatch(events []store.Event) error {
+	return l.queue.submit(events, l.opts.Durable)
+}
+
+func (l *EmbeddedTransactionLogger) Err() <-chan error {
+	return l.errors
+}
+
+func (l *EmbeddedTransactionLogger) Run() {
+	q := newQueue(16)
+	l.queue = q
+
+	errs := make(chan error, 1)
+	l.errors = errs
+
+	go func() {
+		defer close(q.drained)
+
+		var (
+			group   []request
+			written []store.Event
+			ok      bool
+		)
+
+		for {
+			if group, ok = nextGroup(q.requests, group[:0]); !ok {
+				return
+			}
+
+			// The whole group is one transaction, sequences handed out by a
+			// transaction that fails are rolled back along with it.
+			now := time.Now()
+
+			err := l.db.Update(func(tx *bolt.Tx) error {
+				b := tx.Bucket(eventsBucket)
+
+				written = written[:0]
+				for _, r := range group {
+					for _, e := range r.events {
+						seq, err := b.NextSequence()
+						if err != nil {
+							return err
+						}
+						e.Sequence = store.Sequence(seq)
+						if e.Timestamp.IsZero() {
+							e.Timestamp = now
+						}
+
+						if err := b.Put(sequenceKey(e.Sequence), appendPayload(nil, []store.Event{e})); err != nil {
+							return err
+						}
+						written = append(written, e)
+					}
+				}
+
+				return nil
+			})
+
+			for _, r := range group {
+				r.finish(err)
+			}
+
+			if err != nil {
+				err = fmt.Errorf("transaction log write failure: %w", err)
+				l.degrade(err)
+				report(errs, err)
+				continue
+			}
+
+			l.recover()
+			l.publish(written...)
+		}
+	}()
+}
+
+func sequenceKey(seq store.Sequence) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(seq))
+}
+
+func (l *EmbeddedTransactionLogger) ReadEvents() (<-chan store.Event, <-chan error) {
+	return l.read(0)
+}
+
+func (l *EmbeddedTransactionLogger) ReadEventsFrom(from store.Sequence) (<-chan store.Event, <-chan error) {
+	if from > 0 && from <= store.Sequence(l.compacted.Load()) {
+		return readFailed(fmt.Errorf("%w: sequence %d", ErrCompacted, from))
+	}
+
+	return l.read(from)
+}
+
+// read sends the events from sequence from onwards, readChunk at a time.
+func (l *EmbeddedTransactionLogger) read(from store.Sequence) (<-chan store.Event, <-chan error) {
+	outEvent := make(chan store.Event)
+	outError := make(chan error, 1)
+
+	go func() {
+		defer close(outEvent)
+		defer close(outError)
+
+		chunk := make([]store.Event, 0, readChunk)
+
+		for {
+			chunk = chunk[:0]
+
+			err := l.db.View(func(tx *bolt.Tx) error {
+				c := tx.Bucket(eventsBucket).Cursor()
+
+				for k, v := c.Seek(sequenceKey(from)); k != nil && len(chunk) < readChunk; k, v = c.Next() {
+					events, err := decodeRecord(v, fileVersion)
+					if err == nil && len(events) != 1 {
+						err = errBadRecord
+					}
+					if err != nil {
+						return fmt.Errorf("event %d: %w", binary.BigEndian.Uint64(k), err)
+					}
+					chunk = append(chunk, events[0])
+				}
+
+				return nil
+			})
+			if err != nil {
+				outError <- fmt.Errorf("transaction log read failure: %w", err)
+				return
+			}
+
+			for _, e := range chunk {
+				outEvent <- e
+			}
+
+			if len(chunk) < readChunk {
+				return
+			}
+			from = chunk[len(chunk)-1].Sequence + 1
+		}
+	}()
+
+	return outEvent, outError
+}
+
+// Import writes each chunk of events in a transaction of its own and moves
+// the bucket sequence along with them.
+func (l *EmbeddedTransactionLogger) Import(s *store.Snapshot, events <-chan store.Event) error {
+	if s != nil {
+		if err := l.Compact(*s); err != nil {
+			return err
+		}
+	}
+
+	var last store.Sequence
+
+	// Sequences carry on after the snapshot even if no events follow it.
+	err := l.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(eventsBucket)
+		last = max(store.Sequence(b.Sequence()), store.Sequence(l.compacted.Load()))
+		return b.SetSequence(uint64(last))
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = importChunks(events, last, func(chunk []store.Event) error {
+		return l.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(eventsBucket)
+
+			for _, e := range chunk {
+				if err := b.Put(sequenceKey(e.Sequence), appendPayload(nil, []store.Event{e})); err != nil {
+					return err
+				}
+			}
+
+			return b.SetSequence(uint64(chunk[len(chunk)-1].Sequence))
+		})
+	})
+
+	return err
+}
+
+func (l *EmbeddedTransactionLogger) LoadSnapshot() (*store.Snapshot, error) {
+	var s *store.Snapshot
+
+	err := l.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(metaBucket).Get(snapshotKey)
+		if b == nil {
+			return nil
+		}
+
+		var err error
+		s, err = decodeSnapshot(b)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("snapshot: %w", err)
+	}
+
+	return s, nil
+}
+
+// Compact stores s and deletes the events it covers in one transaction.
+func (l *EmbeddedTransactionLogger) Compact(s store.Snapshot) error {
+	if s.Sequence < store.Sequence(l.compacted.Load()) {
+		return fmt.Errorf("snapshot at sequence %d is older than the current one", s.Sequence)
+	}
+
+	err := l.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(metaBucket).Put(snapshotKey, encodeSnapshot(s)); err != nil {
+			return err
+		}
+
+		// Deleting moves the cursor on by itself, so it starts over each time.
+		c := tx.Bucket(eventsBucket).Cursor()
+		for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) <= uint64(s.Sequence); k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	l.compacted.Store(uint64(s.Sequence))
+
+	return nil
+}
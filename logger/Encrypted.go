@@ -0,0 +1,218 @@
+package logger
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"gitlab.com/linkinlog/cloudKV/store"
+)
+
+type EncryptionOptions struct {
+	// KeyFile turns encryption on. It holds one base64 encoded AES key per
+	// line, 32 bytes for AES-256, and the first one encrypts.
+	//
+	// To rotate keys, put a new one first and restart. Compaction re-encrypts
+	// the snapshot under it, but the old key has to stay in the file until
+	// every event logged under it has been compacted, which takes as long as
+	// the retention period.
+	KeyFile string `json:"key_file,omitempty"`
+}
+
+// NewEncryptedTransactionLogger encrypts the keys and values of everything
+// written to l with AES-GCM, snapshots included, and decrypts them as they
+// are read back. Content types, timestamps and origins are left readable.
+//
+// Events logged before encryption was turned on are read as they are, and
+// encrypted once compaction folds them into a snapshot. Sealed keys differ
+// every time, so key history is found by reading the whole log.
+func NewEncryptedTransactionLogger(l Logger, opts EncryptionOptions) (*EncryptedTransactionLogger, error) {
+	keys, err := loadKeyring(opts.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the key file: %w", err)
+	}
+
+	return &EncryptedTransactionLogger{Logger: l, keys: keys}, nil
+}
+
+// EncryptedTransactionLogger wraps another logger, everything it doesn't
+// override goes straight through.
+type EncryptedTransactionLogger struct {
+	Logger
+	keys keyring
+}
+
+func (l *EncryptedTransactionLogger) LogPut(key string, value []byte, contentType string, expires time.Time) error {
+	return l.Logger.LogPut(l.keys.sealKey(key), l.keys.sealValue(key, value), contentType, expires)
+}
+
+func (l *EncryptedTransactionLogger) LogDelete(key string) error {
+	return l.Logger.LogDelete(l.keys.sealKey(key))
+}
+
+func (l *EncryptedTransactionLogger) LogBatch(events []store.Event) error {
+	sealed := make([]store.Event, len(events))
+	for i, e := range events {
+		sealed[i] = l.keys.sealEvent(e)
+	}
+	return l.Logger.LogBatch(sealed)
+}
+
+func (l *EncryptedTransactionLogger) ReadEvents() (<-chan store.Event, <-chan error) {
+	return l.decrypt(l.Logger.ReadEvents())
+}
+
+func (l *EncryptedTransactionLogger) ReadEventsFrom(from store.Sequence) (<-chan store.Event, <-chan error) {
+	return l.decrypt(l.Logger.ReadEventsFrom(from))
+}
+
+// decrypt opens the events a read yields. Events a snapshot covers may still be in
+// the log under a key that has since been dropped, those are skipped.
+func (l *EncryptedTransactionLogger) decrypt(events <-chan store.Event, errs <-chan error) (<-chan store.Event, <-chan error) {
+	outEvent := make(chan store.Event)
+	outError := make(chan error, 1)
+
+	go func() {
+		defer close(outEvent)
+		defer close(outError)
+
+		var (
+			covered store.Sequence
+			loaded  bool
+		)
+
+		for e := range events {
+			plain, err := l.keys.openEvent(e)
+
+			if errors.Is(err, errUnknownKey) {
+				if !loaded {
+					snap, serr := l.Logger.LoadSnapshot()
+					if serr == nil && snap != nil {
+						covered = snap.Sequence
+					}
+					loaded = true
+				}
+				if e.Sequence <= covered {
+					continue
+				}
+			}
+
+			if err != nil {
+				for range events {
+				}
+				<-errs
+				outError <- fmt.Errorf("event %d: %w", e.Sequence, err)
+				return
+			}
+
+			outEvent <- plain
+		}
+
+		if err := <-errs; err != nil {
+			outError <- err
+		}
+	}()
+
+	return outEvent, outError
+}
+
+// Subscribe drops subscribers that fall behind, like every logger, or whose
+// events can't be decrypted.
+func (l *EncryptedTransactionLogger) Subscribe() (<-chan store.Event, func()) {
+	in, cancel := l.Logger.Subscribe()
+	out := make(chan store.Event, feedBuffer)
+
+	go func() {
+		defer close(out)
+
+		for e := range in {
+			plain, err := l.keys.openEvent(e)
+			if err != nil {
+				cancel()
+				return
+			}
+
+			select {
+			case out <- plain:
+			default:
+				cancel()
+				return
+			}
+		}
+	}()
+
+	return out, cancel
+}
+
+func (l *EncryptedTransactionLogger) LoadSnapshot() (*store.Snapshot, error) {
+	s, err := l.Logger.LoadSnapshot()
+	if err != nil || s == nil {
+		return s, err
+	}
+
+	// Loggers may hand out a snapshot they keep, so it is copied.
+	plain := *s
+	plain.Entries = make([]store.KeyValue, len(s.Entries))
+
+	for i, kv := range s.Entries {
+		if kv.Key, err = l.keys.openKey(kv.Key); err != nil {
+			return nil, fmt.Errorf("snapshot: %w", err)
+		}
+		if kv.Value, err = l.keys.openValue(kv.Key, kv.Value); err != nil {
+			return nil, fmt.Errorf("snapshot: %w", err)
+		}
+		plain.Entries[i] = kv
+	}
+
+	// Sealed keys sort differently.
+	slices.SortFunc(plain.Entries, func(a, b store.KeyValue) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+
+	return &plain, nil
+}
+
+// Compact encrypts s under the newest key, which is how snapshots move on to
+// a new key after a rotation.
+func (l *EncryptedTransactionLogger) Compact(s store.Snapshot) error {
+	return l.Logger.Compact(l.seal(s))
+}
+
+func (l *EncryptedTransactionLogger) seal(s store.Snapshot) store.Snapshot {
+	entries := make([]store.KeyValue, len(s.Entries))
+	for i, kv := range s.Entries {
+		kv.Value = l.keys.sealValue(kv.Key, kv.Value)
+		kv.Key = l.keys.sealKey(kv.Key)
+		entries[i] = kv
+	}
+	s.Entries = entries
+	return s
+}
+
+// Import encrypts what it is given on the way into the wrapped logger.
+func (l *EncryptedTransactionLogger) Import(s *store.Snapshot, events <-chan store.Event) error {
+	importer, ok := l.Logger.(Importer)
+	if !ok {
+		return errors.New("the logger can't be imported into")
+	}
+
+	if s != nil {
+		sealed := l.seal(*s)
+		s = &sealed
+	}
+
+	sealed := make(chan store.Event)
+	go func() {
+		defer close(sealed)
+		for e := range events {
+			sealed <- l.keys.sealEvent(e)
+		}
+	}()
+
+	err := importer.Import(s, sealed)
+	for range sealed {
+	}
+	return err
+}
@@ -2,43 +2,194 @@ package logger
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"os"
-	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"gitlab.com/linkinlog/cloudKV/store"
 )
 
-func NewFileTransactionLogger(filename string) (*FileTransactionLogger, error) {
-	file, err := os.OpenFile(filename, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+// ErrDamagedTail is reported when the end of a file log is cut short or fails
+// its checksum, which is what a crash in the middle of a write leaves behind.
+var ErrDamagedTail = errors.New("damaged transaction log tail")
+
+// ErrCorruptLog is returned on open for a file log with a bad record before
+// good ones, which is damage rather than a write cut short. Cutting it off
+// would lose every good record after it, so it has to be repaired by hand.
+var ErrCorruptLog = errors.New("corrupt transaction log")
+
+type FileOptions struct {
+	// Strict refuses to open a log with a damaged tail, instead of cutting
+	// the tail off and carrying on without it.
+	Strict bool `json:"strict"`
+	// Durable makes LogPut, LogDelete and LogBatch wait until their record is
+	// written, and synced too under FsyncAlways. Concurrent calls share one
+	// write and sync.
+	Durable bool `json:"durable"`
+	// Fsync defaults to FsyncAlways for durable logs and FsyncOS otherwise.
+	Fsync FsyncPolicy `json:"fsync"`
+	// SegmentSize is how many bytes a segment grows to before the log rolls
+	// over to a new one, DefaultSegmentSize if zero.
+	SegmentSize int64 `json:"segment_size,omitempty"`
+	// SegmentAge rolls the log over once a segment has been written to for
+	// this long, zero means segments only roll over on size.
+	SegmentAge Duration `json:"segment_age,omitempty"`
+}
+
+// NewFileTransactionLogger opens the segmented log whose segments are named
+// after filename, see segment.go. A single file log at filename from before
+// segments existed becomes the first segment.
+func NewFileTransactionLogger(filename string, opts FileOptions) (*FileTransactionLogger, error) {
+	switch {
+	case opts.Fsync == "" && opts.Durable:
+		opts.Fsync = FsyncAlways
+	case opts.Fsync == "":
+		opts.Fsync = FsyncOS
+	case !opts.Fsync.valid():
+		return nil, fmt.Errorf("invalid fsync policy %q", opts.Fsync)
+	}
+
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = DefaultSegmentSize
+	}
+
+	ftl := &FileTransactionLogger{filename: filename, opts: opts}
+
+	seq, err := snapshotSequence(ftl.snapshotName())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	ftl.compacted.Store(uint64(seq))
+
+	if err := splitSingleFile(filename, seq+1); err != nil {
+		return nil, fmt.Errorf("failed to upgrade transaction log: %w", err)
+	}
+
+	if ftl.segments, err = listSegments(filename); err != nil {
+		return nil, err
+	}
+	if len(ftl.segments) == 0 {
+		ftl.segments = []segment{{start: seq + 1, name: segmentName(filename, seq+1)}}
+	}
+
+	// Only the last segment was being appended to, so only it can have a
+	// damaged tail.
+	active := ftl.segments[len(ftl.segments)-1]
+
+	file, err := os.OpenFile(active.name, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if ftl.version, ftl.damage, err = recoverTail(file, opts.Strict); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	info, err := file.Stat()
 	if err != nil {
+		_ = file.Close()
 		return nil, err
 	}
 
-	return &FileTransactionLogger{file: file}, nil
+	ftl.size = info.Size()
+
+	// An active segment of an older version is rolled over before the next
+	// write, unless it has nothing in it and can simply start again.
+	if ftl.size == int64(len(fileHeader)) && ftl.version != fileVersion {
+		if err := file.Truncate(0); err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+		ftl.size = 0
+	}
+
+	if ftl.size == 0 {
+		if _, err := file.Write(fileHeader); err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+		ftl.size = int64(len(fileHeader))
+		ftl.version = fileVersion
+	}
+
+	ftl.file = file
+	ftl.opened = time.Now()
+
+	return ftl, nil
 }
 
 type FileTransactionLogger struct {
-	events chan<- store.Event
-	errors chan error
-	last   store.Sequence
-	file   *os.File
+	feed
+	health
+
+	queue    *queue
+	errors   chan error
+	last     store.Sequence
+	filename string
+	opts     FileOptions
+
+	// mu guards the segment index and the active segment, which is always
+	// the last one in it.
+	mu       sync.Mutex
+	segments []segment
+	file     *os.File
+	size     int64
+	opened   time.Time
+	// version is the format of the active segment.
+	version byte
+
+	// compacted is the sequence covered by the latest snapshot. Sequences
+	// carry on after it even once every event in the log is compacted away.
+	compacted atomic.Uint64
+
+	// flusher syncs file once a second under FsyncEverySec, it is nil otherwise.
+	flusher *flusher
+
+	// damage describes the tail cut off on open, if any, and is reported on
+	// Err once the logger runs.
+	damage error
 }
 
 func (ftl *FileTransactionLogger) Close() error {
-	return ftl.file.Close()
-}
+	ftl.queue.close()
 
-func (ftl *FileTransactionLogger) LogPut(key, value string) error {
-	ftl.events <- store.Event{EventType: store.EventPut, Key: key, Value: value}
+	var err error
+	if ftl.flusher != nil {
+		err = ftl.flusher.close()
+	}
 
-	return nil
+	ftl.mu.Lock()
+	defer ftl.mu.Unlock()
+
+	return errors.Join(err, ftl.file.Close())
+}
+
+func (ftl *FileTransactionLogger) LogPut(key string, value []byte, contentType string, expires time.Time) error {
+	return ftl.LogBatch([]store.Event{{
+		EventType:   store.EventPut,
+		Key:         key,
+		Value:       value,
+		ContentType: contentType,
+		Expires:     expires,
+	}})
 }
 
 func (ftl *FileTransactionLogger) LogDelete(key string) error {
-	ftl.events <- store.Event{EventType: store.EventDelete, Key: key}
+	return ftl.LogBatch([]store.Event{{EventType: store.EventDelete, Key: key}})
+}
 
-	return nil
+// LogBatch turns away batches that wouldn't fit in one record, a log with
+// such a record in it couldn't be read back.
+func (ftl *FileTransactionLogger) LogBatch(events []store.Event) error {
+	if err := CheckBatch(events); err != nil {
+		return err
+	}
+	return ftl.queue.submit(events, ftl.opts.Durable)
 }
 
 func (ftl *FileTransactionLogger) Err() <-chan error {
@@ -46,69 +197,397 @@ func (ftl *FileTransactionLogger) Err() <-chan error {
 }
 
 func (ftl *FileTransactionLogger) Run() {
-	events := make(chan store.Event, 16)
-	ftl.events = events
+	q := newQueue(16)
+	ftl.queue = q
 
 	errors := make(chan error, 1)
 	ftl.errors = errors
 
+	if ftl.damage != nil {
+		errors <- ftl.damage
+	}
+
+	if ftl.opts.Fsync == FsyncEverySec {
+		ftl.flusher = startFlusher(func() error {
+			ftl.mu.Lock()
+			defer ftl.mu.Unlock()
+			return syncFile(ftl.file, FsyncEverySec)
+		}, errors)
+	}
+
 	go func() {
-		for e := range events {
-			ftl.last++
+		defer close(q.drained)
 
-			_, err := fmt.Fprintf(
-				ftl.file,
-				"%d\t%d\t%s\t%s\n",
-				ftl.last, e.EventType, e.Key, e.Value,
-			)
-			if err != nil {
-				errors <- err
+		var (
+			buf    []byte
+			group  []request
+			failed error
+			ok     bool
+		)
+
+		for {
+			if group, ok = nextGroup(q.requests, group[:0]); !ok {
 				return
 			}
+
+			// Once a write fails the end of the file is in an unknown state,
+			// so nothing more is appended to it.
+			if failed != nil {
+				for _, r := range group {
+					r.finish(failed)
+				}
+				continue
+			}
+
+			ftl.mu.Lock()
+
+			ftl.catchUp()
+
+			// Every call gets a record of its own, so a batch stays atomic,
+			// but the whole group goes out in one write.
+			var written []store.Event
+			buf = buf[:0]
+			now := time.Now()
+			for _, r := range group {
+				start := len(written)
+				for _, e := range r.events {
+					ftl.last++
+					e.Sequence = ftl.last
+					if e.Timestamp.IsZero() {
+						e.Timestamp = now
+					}
+					written = append(written, e)
+				}
+				buf = appendRecord(buf, written[start:])
+			}
+
+			var err error
+			if ftl.full(len(buf)) {
+				err = ftl.roll(written[0].Sequence)
+			}
+			if err == nil {
+				_, err = ftl.file.Write(buf)
+				ftl.size += int64(len(buf))
+			}
+			if err == nil && ftl.opts.Fsync == FsyncAlways {
+				err = syncFile(ftl.file, FsyncAlways)
+			}
+			if err == nil && ftl.flusher != nil {
+				ftl.flusher.dirty.Store(true)
+			}
+
+			ftl.mu.Unlock()
+
+			for _, r := range group {
+				r.finish(err)
+			}
+
+			if err != nil {
+				failed = fmt.Errorf("transaction log write failure: %w", err)
+				ftl.degrade(failed)
+				report(errors, failed)
+				continue
+			}
+
+			ftl.publish(written...)
 		}
 	}()
 }
 
+// Import writes up to readChunk events to a record, fewer if they are large,
+// and syncs every chunk.
+func (ftl *FileTransactionLogger) Import(s *store.Snapshot, events <-chan store.Event) error {
+	if s != nil {
+		if err := ftl.Compact(*s); err != nil {
+			return err
+		}
+	}
+
+	ftl.mu.Lock()
+	defer ftl.mu.Unlock()
+
+	ftl.catchUp()
+
+	last, err := importChunks(events, ftl.last, func(chunk []store.Event) error {
+		buf, err := appendRecords(nil, chunk)
+		if err != nil {
+			return err
+		}
+
+		if ftl.full(len(buf)) {
+			if err := ftl.roll(chunk[0].Sequence); err != nil {
+				return err
+			}
+		}
+
+		if _, err := ftl.file.Write(buf); err != nil {
+			return err
+		}
+		ftl.size += int64(len(buf))
+
+		return syncFile(ftl.file, FsyncAlways)
+	})
+	if err != nil {
+		return err
+	}
+
+	ftl.last = last
+
+	return nil
+}
+
 func (ftl *FileTransactionLogger) ReadEvents() (<-chan store.Event, <-chan error) {
-	scanner := bufio.NewScanner(ftl.file)
+	return ftl.read(0)
+}
+
+func (ftl *FileTransactionLogger) ReadEventsFrom(from store.Sequence) (<-chan store.Event, <-chan error) {
+	if from > 0 && from <= store.Sequence(ftl.compacted.Load()) {
+		return readFailed(fmt.Errorf("%w: sequence %d", ErrCompacted, from))
+	}
+
+	return ftl.read(from)
+}
+
+// read parses the log through handles of its own, so it is safe to call
+// while Run is appending. It starts at the segment holding from and follows
+// the index as segments are added. Only events from sequence from onwards are
+// sent, but every sequence it sees moves last along, which is how a logger
+// learns where its log is up to.
+func (ftl *FileTransactionLogger) read(from store.Sequence) (<-chan store.Event, <-chan error) {
 	outEvent := make(chan store.Event)
 	outError := make(chan error, 1)
 
 	go func() {
-		var e store.Event
-
 		defer close(outEvent)
 		defer close(outError)
 
-		for scanner.Scan() {
-			line := scanner.Text()
+		var last store.Sequence
+
+		seg, ok := ftl.segmentFor(from)
+		for ok {
+			next, sealed := ftl.segmentAfter(seg.start)
 
-			line = strings.ReplaceAll(line, " ", "_")
-			if _, err := fmt.Sscanf(
-				line, "%d\t%d\t%s\t%s",
-				&e.Sequence, &e.EventType, &e.Key, &e.Value,
-			); err != nil {
-				outError <- fmt.Errorf("input parse error: %w", err)
+			if err := ftl.readSegment(seg, from, &last, outEvent, sealed); err != nil {
+				outError <- err
 				return
 			}
-			e.Key = strings.ReplaceAll(e.Key, "_", " ")
-			e.Value = strings.ReplaceAll(e.Value, "_", " ")
 
-			if ftl.last >= e.Sequence {
-				outError <- fmt.Errorf("sequence number error: %d >= %d", ftl.last, e.Sequence)
-				return
+			if !sealed {
+				// Run may have rolled over while this segment was read.
+				next, sealed = ftl.segmentAfter(seg.start)
+			}
+			seg, ok = next, sealed
+		}
+
+		ftl.mu.Lock()
+		ftl.last = max(ftl.last, last)
+		ftl.mu.Unlock()
+	}()
+
+	return outEvent, outError
+}
+
+func (ftl *FileTransactionLogger) readSegment(
+	seg segment,
+	from store.Sequence,
+	last *store.Sequence,
+	out chan<- store.Event,
+	sealed bool,
+) error {
+	file, err := os.Open(seg.name)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: segment %s", ErrCompacted, seg.name)
+	}
+	if err != nil {
+		return fmt.Errorf("transaction log open failure: %w", err)
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	version, err := readVersion(r)
+	if err != nil {
+		return fmt.Errorf("transaction log header: %w", err)
+	}
+
+	for {
+		// Damaged tails are cut off on open, so a record cut short in the
+		// active segment is one Run is still writing. It is left for the
+		// next read. Segments that were rolled over are complete.
+		events, _, err := readRecord(r, version)
+		if errors.Is(err, io.EOF) || (!sealed && errors.Is(err, io.ErrUnexpectedEOF)) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("input parse error in %s: %w", seg.name, err)
+		}
+
+		for _, e := range events {
+			if *last >= e.Sequence {
+				return fmt.Errorf("sequence number error: %d >= %d", *last, e.Sequence)
 			}
 
-			ftl.last = e.Sequence
+			*last = e.Sequence
 
-			outEvent <- e
+			if e.Sequence >= from {
+				out <- e
+			}
 		}
+	}
+}
+
+func (ftl *FileTransactionLogger) segmentFor(from store.Sequence) (segment, bool) {
+	ftl.mu.Lock()
+	defer ftl.mu.Unlock()
+
+	if len(ftl.segments) == 0 {
+		return segment{}, false
+	}
+	return ftl.segments[findSegment(ftl.segments, from)], true
+}
 
-		if err := scanner.Err(); err != nil {
-			outError <- fmt.Errorf("transaction log read failure: %w", err)
-			return
+func (ftl *FileTransactionLogger) segmentAfter(start store.Sequence) (segment, bool) {
+	ftl.mu.Lock()
+	defer ftl.mu.Unlock()
+
+	for _, seg := range ftl.segments {
+		if seg.start > start {
+			return seg, true
 		}
-	}()
+	}
+	return segment{}, false
+}
 
-	return outEvent, outError
+// catchUp moves last past everything already compacted or rolled over, so
+// new sequences never collide with old ones even if the log holds none of
+// them anymore. It must be called with mu held.
+func (ftl *FileTransactionLogger) catchUp() {
+	active := ftl.segments[len(ftl.segments)-1]
+	ftl.last = max(ftl.last, store.Sequence(ftl.compacted.Load()), active.start-1)
+}
+
+// full reports whether writing n more bytes should go to a new segment.
+// Segments always take at least one record, however large, and records are
+// never appended to a segment of an older version. It must be called with mu
+// held.
+func (ftl *FileTransactionLogger) full(n int) bool {
+	if ftl.size <= int64(len(fileHeader)) {
+		return false
+	}
+	if ftl.version != fileVersion || ftl.size+int64(n) > ftl.opts.SegmentSize {
+		return true
+	}
+	return ftl.opts.SegmentAge > 0 && time.Since(ftl.opened) >= time.Duration(ftl.opts.SegmentAge)
+}
+
+// roll syncs and closes the active segment and starts a new one at start.
+// It must be called with mu held.
+func (ftl *FileTransactionLogger) roll(start store.Sequence) error {
+	if err := syncFile(ftl.file, ftl.opts.Fsync); err != nil {
+		return err
+	}
+
+	seg := segment{start: start, name: segmentName(ftl.filename, start)}
+
+	file, err := os.OpenFile(seg.name, os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(fileHeader); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	_ = ftl.file.Close()
+
+	ftl.file = file
+	ftl.size = int64(len(fileHeader))
+	ftl.opened = time.Now()
+	ftl.version = fileVersion
+	ftl.segments = append(ftl.segments, seg)
+
+	return nil
+}
+
+// recoverTail checks every record in file and truncates it at the first one
+// that is cut short or corrupt. It returns the version of the log and an
+// ErrDamagedTail describing what was dropped, or nil if the log was intact.
+// In strict mode a damaged log is returned as an error and left untouched.
+// So is a log with good records after the bad one, as ErrCorruptLog.
+func recoverTail(file *os.File, strict bool) (version byte, damage error, err error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	r := bufio.NewReader(file)
+
+	var (
+		offset int64
+		cause  error
+	)
+
+	version, err = readVersion(r)
+	switch {
+	case errors.Is(err, errTruncatedHeader):
+		cause = err
+	case err != nil:
+		return 0, nil, err
+	case version < 2:
+		// Segments never held anything older, splitSingleFile upgrades it.
+		return 0, nil, fmt.Errorf("unexpected transaction log version %d", version)
+	default:
+		var last store.Sequence
+		offset = int64(len(fileHeader))
+		for {
+			events, size, err := readRecord(r, version)
+			if errors.Is(err, io.EOF) {
+				return version, nil, nil
+			}
+			if err != nil {
+				cause = err
+				break
+			}
+			offset += size
+			if len(events) > 0 {
+				last = events[len(events)-1].Sequence
+			}
+		}
+
+		// A torn write only ever leaves garbage at the very end. Records
+		// that still check out after the bad one were acknowledged, so they
+		// aren't cut off with it, strict or not.
+		rest := make([]byte, info.Size()-offset)
+		if _, err := file.ReadAt(rest, offset); err != nil {
+			return 0, nil, err
+		}
+		if at := findRecord(rest, version, last); at >= 0 {
+			return 0, nil, fmt.Errorf(
+				"%w: %s has a bad record at offset %d but a good one at offset %d: %v",
+				ErrCorruptLog, file.Name(), offset, offset+int64(at), cause,
+			)
+		}
+	}
+
+	damage = fmt.Errorf(
+		"%w: %s has %d bad bytes at offset %d: %v",
+		ErrDamagedTail, file.Name(), info.Size()-offset, offset, cause,
+	)
+
+	if strict {
+		return 0, nil, fmt.Errorf("%w, refusing to start in strict mode", damage)
+	}
+
+	if err := file.Truncate(offset); err != nil {
+		return 0, nil, err
+	}
+	if err := file.Sync(); err != nil {
+		return 0, nil, err
+	}
+
+	return version, fmt.Errorf("%w, truncated", damage), nil
 }
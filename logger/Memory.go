@@ -0,0 +1,191 @@
+package logger
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"gitlab.com/linkinlog/cloudKV/store"
+)
+
+// MemoryTransactionLogger keeps its log in memory, so nothing survives the
+// process. It is meant for tests and throwaway instances. Every call is
+// persisted, as far as memory goes, before it returns.
+type MemoryTransactionLogger struct {
+	feed
+	health
+
+	errors chan error
+	log    *memoryLog
+	closed bool
+}
+
+// memoryLog is what a MemoryTransactionLogger and the ones Reopen hands out
+// share.
+type memoryLog struct {
+	lock     sync.RWMutex
+	events   []store.Event
+	last     store.Sequence
+	snapshot *store.Snapshot
+}
+
+func NewMemoryTransactionLogger() *MemoryTransactionLogger {
+	return &MemoryTransactionLogger{log: &memoryLog{}, errors: make(chan error, 1)}
+}
+
+// Reopen returns a new logger over the same log, as if the process had
+// restarted with the log intact.
+func (l *MemoryTransactionLogger) Reopen() *MemoryTransactionLogger {
+	return &MemoryTransactionLogger{log: l.log, errors: make(chan error, 1)}
+}
+
+func (l *MemoryTransactionLogger) Close() error {
+	l.log.lock.Lock()
+	defer l.log.lock.Unlock()
+
+	l.closed = true
+
+	return nil
+}
+
+func (l *MemoryTransactionLogger) LogPut(key string, value []byte, contentType string, expires time.Time) error {
+	return l.LogBatch([]store.Event{{
+		EventType:   store.EventPut,
+		Key:         key,
+		Value:       value,
+		ContentType: contentType,
+		Expires:     expires,
+	}})
+}
+
+func (l *MemoryTransactionLogger) LogDelete(key string) error {
+	return l.LogBatch([]store.Event{{EventType: store.EventDelete, Key: key}})
+}
+
+func (l *MemoryTransactionLogger) LogBatch(events []store.Event) error {
+	l.log.lock.Lock()
+	defer l.log.lock.Unlock()
+
+	if l.closed {
+		return ErrClosed
+	}
+
+	now := time.Now()
+
+	written := make([]store.Event, 0, len(events))
+	for _, e := range events {
+		l.log.last++
+		e.Sequence = l.log.last
+		if e.Timestamp.IsZero() {
+			e.Timestamp = now
+		}
+		e.Value = bytes.Clone(e.Value)
+		written = append(written, e)
+	}
+	l.log.events = append(l.log.events, written...)
+
+	// Publishing under the lock keeps subscribers in sequence order.
+	l.publish(written...)
+
+	return nil
+}
+
+func (l *MemoryTransactionLogger) Err() <-chan error {
+	return l.errors
+}
+
+func (l *MemoryTransactionLogger) Run() {}
+
+func (l *MemoryTransactionLogger) ReadEvents() (<-chan store.Event, <-chan error) {
+	return l.read(0)
+}
+
+func (l *MemoryTransactionLogger) ReadEventsFrom(from store.Sequence) (<-chan store.Event, <-chan error) {
+	l.log.lock.RLock()
+	snapshot := l.log.snapshot
+	l.log.lock.RUnlock()
+
+	if from > 0 && snapshot != nil && from <= snapshot.Sequence {
+		return readFailed(fmt.Errorf("%w: sequence %d", ErrCompacted, from))
+	}
+
+	return l.read(from)
+}
+
+// read sends a copy of the events from sequence from onwards, as they were
+// when it was called.
+func (l *MemoryTransactionLogger) read(from store.Sequence) (<-chan store.Event, <-chan error) {
+	l.log.lock.RLock()
+	var events []store.Event
+	for _, e := range l.log.events {
+		if e.Sequence >= from {
+			e.Value = bytes.Clone(e.Value)
+			events = append(events, e)
+		}
+	}
+	l.log.lock.RUnlock()
+
+	outEvent := make(chan store.Event)
+	outError := make(chan error, 1)
+
+	go func() {
+		defer close(outEvent)
+		defer close(outError)
+
+		for _, e := range events {
+			outEvent <- e
+		}
+	}()
+
+	return outEvent, outError
+}
+
+func (l *MemoryTransactionLogger) LoadSnapshot() (*store.Snapshot, error) {
+	l.log.lock.RLock()
+	defer l.log.lock.RUnlock()
+
+	return l.log.snapshot, nil
+}
+
+func (l *MemoryTransactionLogger) Compact(s store.Snapshot) error {
+	l.log.lock.Lock()
+	defer l.log.lock.Unlock()
+
+	if l.log.snapshot != nil && s.Sequence < l.log.snapshot.Sequence {
+		return fmt.Errorf("snapshot at sequence %d is older than the current one", s.Sequence)
+	}
+
+	l.log.snapshot = &s
+	l.log.last = max(l.log.last, s.Sequence)
+
+	n := 0
+	for n < len(l.log.events) && l.log.events[n].Sequence <= s.Sequence {
+		n++
+	}
+	l.log.events = append([]store.Event(nil), l.log.events[n:]...)
+
+	return nil
+}
+
+func (l *MemoryTransactionLogger) Import(s *store.Snapshot, events <-chan store.Event) error {
+	if s != nil {
+		if err := l.Compact(*s); err != nil {
+			return err
+		}
+	}
+
+	l.log.lock.Lock()
+	defer l.log.lock.Unlock()
+
+	last, err := importChunks(events, l.log.last, func(chunk []store.Event) error {
+		for _, e := range chunk {
+			e.Value = bytes.Clone(e.Value)
+			l.log.events = append(l.log.events, e)
+		}
+		return nil
+	})
+	l.log.last = max(l.log.last, last)
+
+	return err
+}
@@ -2,18 +2,57 @@ package logger
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"slices"
+	"sync"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"gitlab.com/linkinlog/cloudKV/store"
 )
 
 const Table = "transactions"
 
-func NewPostgresTransactionLogger(config PostgresDBParams) (*PostgresTransactionLogger, error) {
+type PostgresOptions struct {
+	// Durable makes LogPut, LogDelete and LogBatch wait until their rows are
+	// committed. Concurrent calls share one database transaction.
+	Durable bool `json:"durable"`
+	// BatchSize caps how many events go into one COPY, DefaultBatchSize if zero.
+	BatchSize int `json:"batch_size,omitempty"`
+	// FlushInterval is how long Run waits for a batch to fill up before
+	// writing it anyway. Zero writes whatever is queued straight away.
+	FlushInterval Duration `json:"flush_interval,omitempty"`
+	// BufferSize is how many calls may queue up while Postgres is out of
+	// reach, DefaultBufferSize if zero. Once it is full log calls block until
+	// the connection is back.
+	BufferSize int `json:"buffer_size,omitempty"`
+}
+
+// DefaultBatchSize is how many events the Postgres logger writes at once
+// unless PostgresOptions says otherwise.
+const DefaultBatchSize = 256
+
+// DefaultBufferSize is how many log calls the Postgres logger queues unless
+// PostgresOptions says otherwise.
+const DefaultBufferSize = 1024
+
+// Failed writes are retried with exponential backoff between these bounds.
+const (
+	minRetryBackoff = 100 * time.Millisecond
+	maxRetryBackoff = 30 * time.Second
+)
+
+func NewPostgresTransactionLogger(config PostgresDBParams, opts PostgresOptions) (*PostgresTransactionLogger, error) {
 	connStr := fmt.Sprintf("host=%s dbname=%s user=%s password=%s sslmode=disable",
 		config.host, config.dbName, config.user, config.password)
 
+	return openPostgres(connStr, opts)
+}
+
+// openPostgres connects to the database connStr names, in the lib/pq format,
+// and migrates its schema, the first one on its search path.
+func openPostgres(connStr string, opts PostgresOptions) (*PostgresTransactionLogger, error) {
 	db, err := sql.Open("postgres", connStr)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
@@ -23,16 +62,25 @@ func NewPostgresTransactionLogger(config PostgresDBParams) (*PostgresTransaction
 		return nil, fmt.Errorf("failed to open database connection: %w", err)
 	}
 
-	logger := &PostgresTransactionLogger{db: db}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = DefaultBufferSize
+	}
+
+	logger := &PostgresTransactionLogger{db: db, opts: opts, closed: make(chan struct{})}
+
+	if err := migrate(db); err != nil {
+		return nil, fmt.Errorf("failed to migrate schema: %w", err)
+	}
 
 	exists, err := logger.verifyTableExists(Table)
 	if err != nil {
 		return nil, fmt.Errorf("failed to verify table: %w", err)
 	}
 	if !exists {
-		if err := logger.createTxTable(); err != nil {
-			return nil, fmt.Errorf("failed to create table: %w", err)
-		}
+		return nil, fmt.Errorf("table %s is missing after migrating", Table)
 	}
 
 	return logger, nil
@@ -43,25 +91,41 @@ type PostgresDBParams struct {
 }
 
 type PostgresTransactionLogger struct {
-	events chan<- store.Event
+	feed
+	health
+
+	queue  *queue
 	errors chan error
 	db     *sql.DB
+	opts   PostgresOptions
+
+	// closed stops Run from retrying once the logger is closed.
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
 func (l *PostgresTransactionLogger) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	l.queue.close()
 	return l.db.Close()
 }
 
-func (l *PostgresTransactionLogger) LogPut(key, value string) error {
-	l.events <- store.Event{EventType: store.EventPut, Key: key, Value: value}
-
-	return nil
+func (l *PostgresTransactionLogger) LogPut(key string, value []byte, contentType string, expires time.Time) error {
+	return l.queue.submit([]store.Event{{
+		EventType:   store.EventPut,
+		Key:         key,
+		Value:       value,
+		ContentType: contentType,
+		Expires:     expires,
+	}}, l.opts.Durable)
 }
 
 func (l *PostgresTransactionLogger) LogDelete(key string) error {
-	l.events <- store.Event{EventType: store.EventDelete, Key: key}
+	return l.queue.submit([]store.Event{{EventType: store.EventDelete, Key: key}}, l.opts.Durable)
+}
 
-	return nil
+func (l *PostgresTransactionLogger) LogBatch(events []store.Event) error {
+	return l.queue.submit(events, l.opts.Durable)
 }
 
 func (l *PostgresTransactionLogger) Err() <-chan error {
@@ -69,6 +133,10 @@ func (l *PostgresTransactionLogger) Err() <-chan error {
 }
 
 func (l *PostgresTransactionLogger) ReadEvents() (<-chan store.Event, <-chan error) {
+	return l.ReadEventsFrom(0)
+}
+
+func (l *PostgresTransactionLogger) ReadEventsFrom(from store.Sequence) (<-chan store.Event, <-chan error) {
 	outEvent := make(chan store.Event)
 	outError := make(chan error, 1)
 
@@ -76,9 +144,21 @@ func (l *PostgresTransactionLogger) ReadEvents() (<-chan store.Event, <-chan err
 		defer close(outEvent)
 		defer close(outError)
 
-		query := `select sequence, event_type, key, value from transactions order by sequence`
+		if from > 0 {
+			var compacted store.Sequence
+			if err := l.db.QueryRow(`select coalesce(max(sequence), 0) from snapshots`).Scan(&compacted); err != nil {
+				outError <- fmt.Errorf("sql query error: %w", err)
+				return
+			}
+			if from <= compacted {
+				outError <- fmt.Errorf("%w: sequence %d", ErrCompacted, from)
+				return
+			}
+		}
+
+		query := `select ` + eventColumns + ` from transactions where sequence >= $1 order by sequence`
 
-		rows, err := l.db.Query(query)
+		rows, err := l.db.Query(query, from)
 		if err != nil {
 			outError <- fmt.Errorf("sql query error: %w", err)
 			return
@@ -86,17 +166,10 @@ func (l *PostgresTransactionLogger) ReadEvents() (<-chan store.Event, <-chan err
 
 		defer rows.Close()
 
-		e := store.Event{}
-
 		for rows.Next() {
-			err = rows.Scan(
-				&e.Sequence,
-				&e.EventType,
-				&e.Key,
-				&e.Value,
-			)
+			e, err := scanEvent(rows)
 			if err != nil {
-				outError <- fmt.Errorf("error reading row: %w", err)
+				outError <- err
 				return
 			}
 
@@ -112,75 +185,368 @@ func (l *PostgresTransactionLogger) ReadEvents() (<-chan store.Event, <-chan err
 	return outEvent, outError
 }
 
+// eventColumns are the columns scanEvent reads, in order.
+const eventColumns = `sequence, event_type, key, value, content_type, expires, logged_at, frontend, principal, request_id, version`
+
+func scanEvent(rows *sql.Rows) (store.Event, error) {
+	var (
+		e           store.Event
+		contentType sql.NullString
+		expires     sql.NullTime
+		loggedAt    sql.NullTime
+		frontend    sql.NullString
+		principal   sql.NullString
+		requestID   sql.NullString
+		version     sql.NullInt64
+	)
+
+	err := rows.Scan(
+		&e.Sequence,
+		&e.EventType,
+		&e.Key,
+		&e.Value,
+		&contentType,
+		&expires,
+		&loggedAt,
+		&frontend,
+		&principal,
+		&requestID,
+		&version,
+	)
+	if err != nil {
+		return e, fmt.Errorf("error reading row: %w", err)
+	}
+
+	e.ContentType = contentType.String
+	e.Expires = expires.Time
+	e.Timestamp = loggedAt.Time
+	e.Version = uint64(version.Int64)
+	e.Origin = store.Origin{
+		Frontend:  frontend.String,
+		Principal: principal.String,
+		RequestID: requestID.String,
+	}
+
+	return e, nil
+}
+
+// History looks events up by the index on key and sequence.
+func (l *PostgresTransactionLogger) History(q HistoryQuery) ([]store.Event, error) {
+	query := `select ` + eventColumns + ` from transactions
+		where key = $1 and sequence > $2
+		and ($3::timestamptz is null or logged_at >= $3)
+		and ($4::timestamptz is null or logged_at < $4)
+		order by sequence limit $5`
+
+	rows, err := l.db.Query(query,
+		q.Key, q.After,
+		sql.NullTime{Time: q.Since, Valid: !q.Since.IsZero()},
+		sql.NullTime{Time: q.Until, Valid: !q.Until.IsZero()},
+		q.Limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("sql query error: %w", err)
+	}
+	defer rows.Close()
+
+	var events []store.Event
+	for rows.Next() {
+		e, err := scanEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading rows: %w", err)
+	}
+
+	return events, nil
+}
+
 func (l *PostgresTransactionLogger) Run() {
-	events := make(chan store.Event, 16)
-	l.events = events
+	q := newQueue(l.opts.BufferSize)
+	l.queue = q
 
 	errs := make(chan error, 1)
 	l.errors = errs
 
 	go func() {
-		query := `insert into transactions (event_type, key, value) values ($1, $2, $3)`
-
-		for e := range events {
-			if _, err := l.db.Exec(
-				query,
-				e.EventType,
-				e.Key,
-				e.Value,
-			); err != nil {
-				errs <- err
+		defer close(q.drained)
+
+		var (
+			group []request
+			ok    bool
+		)
+
+		for {
+			group, ok = nextBatch(q.requests, group[:0], l.opts.BatchSize, time.Duration(l.opts.FlushInterval))
+			if !ok {
+				return
+			}
+
+			var batch []store.Event
+			for _, r := range group {
+				batch = append(batch, r.events...)
+			}
+
+			// A failed transaction is rolled back, so unlike the file log
+			// later writes can still go through.
+			err := l.insertRetrying(batch, errs)
+			if err == nil || retryable(err) || len(group) == 1 {
+				for _, r := range group {
+					r.finish(err)
+				}
+				if err != nil {
+					report(errs, err)
+				}
+				continue
+			}
+
+			// Postgres turned down something in the group, such as a key
+			// that isn't valid text. Every call is tried on its own so only
+			// the one it was in fails.
+			for _, r := range group {
+				err := l.insertRetrying(r.events, errs)
+				r.finish(err)
+				if err != nil {
+					report(errs, err)
+				}
 			}
 		}
 	}()
 }
 
-func (l *PostgresTransactionLogger) verifyTableExists(table string) (bool, error) {
-	if l.db != nil {
-		tx, err := l.db.Begin()
-		if err != nil {
-			return false, err
+// insertRetrying inserts batch, and while Postgres is out of reach keeps
+// trying with exponential backoff until it succeeds or the logger is closed.
+// Meanwhile new calls queue up behind it, until the buffer is full and they
+// block. Errors Postgres itself reports about the batch are returned as is.
+//
+// A commit whose acknowledgement is lost with the connection is retried too,
+// so events may be logged twice, replaying them is harmless.
+func (l *PostgresTransactionLogger) insertRetrying(batch []store.Event, errs chan<- error) error {
+	backoff := minRetryBackoff
+
+	err := l.insert(batch)
+	for err != nil && retryable(err) {
+		l.degrade(err)
+		report(errs, fmt.Errorf("retrying in %s: %w", backoff, err))
+
+		select {
+		case <-l.closed:
+			return fmt.Errorf("transaction logger closed while retrying: %w", err)
+		case <-time.After(backoff):
+		}
+
+		backoff = min(backoff*2, maxRetryBackoff)
+		err = l.insert(batch)
+	}
+
+	if err == nil {
+		l.recover()
+	}
+
+	return err
+}
+
+// retryable reports whether err is down to the connection rather than the
+// statements, so trying again later can succeed.
+func retryable(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		// Anything the server didn't answer is a broken or refused connection.
+		return true
+	}
+
+	switch pqErr.Code.Class() {
+	case "08", // connection exception
+		"40", // transaction rollback, such as serialization failures
+		"53", // insufficient resources
+		"57": // operator intervention, such as a server shutting down
+		return true
+	}
+	return false
+}
+
+// insert writes batch with COPY in a single database transaction, so readers
+// see all of it or none. A group of calls is committed together, which keeps
+// each call's batch atomic as well.
+//
+// COPY can't return the sequences it hands out, so they are taken from the
+// column's sequence first, in order, and written explicitly.
+func (l *PostgresTransactionLogger) insert(batch []store.Event) error {
+	tx, err := l.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	rows, err := tx.Query(
+		`select nextval(pg_get_serial_sequence('transactions', 'sequence')) from generate_series(1, $1)`,
+		len(batch),
+	)
+	if err != nil {
+		return err
+	}
+
+	seqs := make([]store.Sequence, 0, len(batch))
+	for rows.Next() {
+		var seq store.Sequence
+		if err := rows.Scan(&seq); err != nil {
+			_ = rows.Close()
+			return err
 		}
-		row := tx.QueryRow(`SELECT EXISTS (
-							   SELECT FROM information_schema.tables
-							   WHERE  table_schema = 'public'
-							   AND    table_name   = $1
-							   );`,
-			table)
-
-		if row.Err() != nil {
-			return false, row.Err()
+		seqs = append(seqs, seq)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(seqs) != len(batch) {
+		return fmt.Errorf("allocated %d sequences for %d events", len(seqs), len(batch))
+	}
+	slices.Sort(seqs)
+
+	now := time.Now()
+
+	written := make([]store.Event, 0, len(batch))
+	for i, e := range batch {
+		e.Sequence = seqs[i]
+		if e.Timestamp.IsZero() {
+			e.Timestamp = now
 		}
-		if err := tx.Commit(); err != nil {
-			return false, err
+		written = append(written, e)
+	}
+
+	if err := copyEvents(tx, written); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	l.publish(written...)
+
+	return nil
+}
+
+// copyEvents writes events with COPY under the sequences they already have.
+func copyEvents(tx *sql.Tx, events []store.Event) error {
+	stmt, err := tx.Prepare(pq.CopyIn(Table, "sequence", "event_type", "key", "value", "content_type", "expires", "logged_at", "frontend", "principal", "request_id", "version"))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, e := range events {
+		if _, err := stmt.Exec(
+			e.Sequence,
+			e.EventType,
+			e.Key,
+			e.Value,
+			e.ContentType,
+			sql.NullTime{Time: e.Expires, Valid: !e.Expires.IsZero()},
+			sql.NullTime{Time: e.Timestamp, Valid: !e.Timestamp.IsZero()},
+			e.Frontend,
+			e.Principal,
+			e.RequestID,
+			sql.NullInt64{Int64: int64(e.Version), Valid: e.Version != 0},
+		); err != nil {
+			return err
 		}
 	}
-	return false, nil
+
+	_, err = stmt.Exec()
+	return err
 }
 
-func (l *PostgresTransactionLogger) createTxTable() error {
-	if l.db != nil {
-		tx, err := l.db.Begin()
-		if err != nil {
+// Import copies events in one transaction per chunk, then moves the
+// column's sequence past them so the sequences handed out afterwards carry on.
+func (l *PostgresTransactionLogger) Import(s *store.Snapshot, events <-chan store.Event) error {
+	var last store.Sequence
+	if err := l.db.QueryRow(`select coalesce(max(sequence), 0) from transactions`).Scan(&last); err != nil {
+		return err
+	}
+
+	if s != nil {
+		if err := l.Compact(*s); err != nil {
 			return err
 		}
+		last = max(last, s.Sequence)
+	}
 
-		createTableQuery := `
-CREate table if not exists transactions (
-  sequence serial primary key,
-  event_type int,
-  key text,
-  value text
-)
-`
-		if _, err = tx.Exec(createTableQuery); err != nil {
+	last, err := importChunks(events, last, func(chunk []store.Event) error {
+		tx, err := l.db.Begin()
+		if err != nil {
 			return err
 		}
+		defer func() { _ = tx.Rollback() }()
 
-		if err := tx.Commit(); err != nil {
+		if err := copyEvents(tx, chunk); err != nil {
 			return err
 		}
+
+		return tx.Commit()
+	})
+	if err != nil || last == 0 {
+		return err
 	}
 
-	return nil
+	_, err = l.db.Exec(`select setval(pg_get_serial_sequence('transactions', 'sequence'), $1)`, last)
+	return err
+}
+
+func (l *PostgresTransactionLogger) LoadSnapshot() (*store.Snapshot, error) {
+	var data []byte
+
+	err := l.db.QueryRow(`select data from snapshots order by sequence desc limit 1`).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sql query error: %w", err)
+	}
+
+	return decodeSnapshot(data)
+}
+
+// Compact stores s and deletes the rows it covers in one transaction, along
+// with any older snapshots.
+func (l *PostgresTransactionLogger) Compact(s store.Snapshot) error {
+	tx, err := l.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err := tx.Exec(
+		`insert into snapshots (sequence, data) values ($1, $2) on conflict (sequence) do update set data = excluded.data, taken = now()`,
+		s.Sequence, encodeSnapshot(s),
+	); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`delete from transactions where sequence <= $1`, s.Sequence); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`delete from snapshots where sequence < $1`, s.Sequence); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (l *PostgresTransactionLogger) verifyTableExists(table string) (bool, error) {
+	var exists bool
+
+	err := l.db.QueryRow(`SELECT EXISTS (
+						   SELECT FROM information_schema.tables
+						   WHERE  table_schema = current_schema()
+						   AND    table_name   = $1
+						   );`,
+		table,
+	).Scan(&exists)
+
+	return exists, err
 }
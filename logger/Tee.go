@@ -0,0 +1,402 @@
+package logger
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"gitlab.com/linkinlog/cloudKV/store"
+)
+
+// TeePolicy decides which loggers have to take an event for a tee's Log
+// calls to succeed.
+type TeePolicy string
+
+const (
+	// TeeAll fails a call unless every logger took it.
+	TeeAll TeePolicy = "all"
+	// TeePrimary only fails a call the primary didn't take and returns as soon
+	// as it has. The secondaries catch up in the background, their failures
+	// are reported on Err and in Health.
+	TeePrimary TeePolicy = "primary"
+)
+
+func (p TeePolicy) valid() bool {
+	switch p {
+	case TeeAll, TeePrimary:
+		return true
+	}
+	return false
+}
+
+type TeeOptions struct {
+	// Primary and Secondaries name the loggers to write to, as in the config's
+	// logger setting. Each one uses its own options.
+	Primary     string   `json:"primary"`
+	Secondaries []string `json:"secondaries"`
+	// Policy defaults to TeePrimary.
+	Policy TeePolicy `json:"policy"`
+}
+
+// newTee opens the loggers opts.Tee names and tees them together.
+func newTee(opts Options) (*TeeTransactionLogger, error) {
+	names := append([]string{opts.Tee.Primary}, opts.Tee.Secondaries...)
+
+	var loggers []Logger
+	closeAll := func() {
+		for _, l := range loggers {
+			_ = l.Close()
+		}
+	}
+
+	for i, name := range names {
+		lt := ToLoggerType(name)
+		if lt == 0 || lt == Tee {
+			closeAll()
+			return nil, fmt.Errorf("tee can't write to logger %q", name)
+		}
+		if slices.Contains(names[:i], name) {
+			closeAll()
+			return nil, fmt.Errorf("tee names logger %q twice", name)
+		}
+
+		// The tee is encrypted as a whole, not every logger in it.
+		l, err := newLogger(lt, opts)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		loggers = append(loggers, l)
+	}
+
+	tee, err := NewTeeTransactionLogger(opts.Tee.Policy, loggers[0], loggers[1:]...)
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+
+	return tee, nil
+}
+
+// NewTeeTransactionLogger writes every event to primary and each of the
+// secondaries. Everything read comes from primary, the secondaries are only
+// written to. They are read through once here, the way the service replays
+// the primary, so they carry on from where their logs left off.
+func NewTeeTransactionLogger(policy TeePolicy, primary Logger, secondaries ...Logger) (*TeeTransactionLogger, error) {
+	switch {
+	case policy == "":
+		policy = TeePrimary
+	case !policy.valid():
+		return nil, fmt.Errorf("invalid tee policy %q", policy)
+	}
+
+	for i, l := range secondaries {
+		events, errs := l.ReadEvents()
+		for range events {
+		}
+		if err := <-errs; err != nil {
+			return nil, fmt.Errorf("secondary %d: %w", i+1, err)
+		}
+	}
+
+	tee := &TeeTransactionLogger{
+		primary: primary,
+		policy:  policy,
+	}
+	for i, l := range secondaries {
+		tee.secondaries = append(tee.secondaries, &teeSecondary{
+			Logger: l,
+			name:   fmt.Sprintf("secondary %d", i+1),
+		})
+	}
+
+	return tee, nil
+}
+
+// teeBacklog is how many groups of events a secondary may fall behind the
+// primary under TeePrimary before it starts missing them.
+const teeBacklog = 64
+
+// teeSecondary is a logger the tee writes to but never reads from.
+type teeSecondary struct {
+	Logger
+	name string
+
+	// Under TeePrimary, groups wait in backlog for the secondary to take
+	// them, and health records it falling too far behind.
+	backlog chan []store.Event
+	done    chan struct{}
+	health
+}
+
+// send queues events for the secondary without waiting on it. Once it has
+// missed a group its log has a gap, so it stays degraded.
+func (s *teeSecondary) send(events []store.Event, errs chan<- error) {
+	select {
+	case s.backlog <- events:
+	default:
+		err := fmt.Errorf("%s: fell %d batches behind, dropped %d events", s.name, teeBacklog, len(events))
+		s.degrade(err)
+		report(errs, err)
+	}
+}
+
+// drain logs what send queued until backlog is closed.
+func (s *teeSecondary) drain(errs chan<- error) {
+	defer close(s.done)
+
+	for events := range s.backlog {
+		if err := s.LogBatch(events); err != nil {
+			report(errs, fmt.Errorf("%s: %w", s.name, err))
+		}
+	}
+}
+
+// TeeTransactionLogger fans writes out to several loggers. Calls go through
+// a queue of its own and every logger gets each group of them as one
+// LogBatch, so they all log events in the same order. A call returns once
+// the loggers the policy waits for have taken it, whether that means
+// persisted is up to their own durability options.
+//
+// Snapshots only compact the primary, sequences differ between loggers, so
+// the secondaries keep their whole log.
+type TeeTransactionLogger struct {
+	primary     Logger
+	secondaries []*teeSecondary
+	policy      TeePolicy
+
+	queue  *queue
+	errors chan error
+	done   chan struct{}
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// Close closes every logger, only the first call does anything.
+func (l *TeeTransactionLogger) Close() error {
+	l.closeOnce.Do(func() { l.closeErr = l.close() })
+	return l.closeErr
+}
+
+func (l *TeeTransactionLogger) close() error {
+	l.queue.close()
+
+	// The secondaries are given what they have yet to log before they close.
+	for _, s := range l.secondaries {
+		if s.backlog != nil {
+			close(s.backlog)
+			<-s.done
+		}
+	}
+
+	errs := []error{l.primary.Close()}
+	for _, s := range l.secondaries {
+		errs = append(errs, s.Close())
+	}
+
+	if l.done != nil {
+		close(l.done)
+	}
+
+	return errors.Join(errs...)
+}
+
+func (l *TeeTransactionLogger) LogPut(key string, value []byte, contentType string, expires time.Time) error {
+	return l.LogBatch([]store.Event{{
+		EventType:   store.EventPut,
+		Key:         key,
+		Value:       value,
+		ContentType: contentType,
+		Expires:     expires,
+	}})
+}
+
+func (l *TeeTransactionLogger) LogDelete(key string) error {
+	return l.LogBatch([]store.Event{{EventType: store.EventDelete, Key: key}})
+}
+
+// LogBatch turns away batches too large for a file log, whichever loggers
+// the tee writes to, so they all take the same calls.
+func (l *TeeTransactionLogger) LogBatch(events []store.Event) error {
+	if err := CheckBatch(events); err != nil {
+		return err
+	}
+	return l.queue.submit(events, true)
+}
+
+// Err merges what every logger reports.
+func (l *TeeTransactionLogger) Err() <-chan error {
+	return l.errors
+}
+
+// Health reports every logger that is degraded.
+func (l *TeeTransactionLogger) Health() error {
+	var errs []error
+	if err := l.primary.Health(); err != nil {
+		errs = append(errs, fmt.Errorf("primary: %w", err))
+	}
+	for _, s := range l.secondaries {
+		if err := s.health.Health(); err != nil {
+			errs = append(errs, err)
+		}
+		if err := s.Logger.Health(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (l *TeeTransactionLogger) Run() {
+	l.primary.Run()
+	for _, s := range l.secondaries {
+		s.Run()
+	}
+
+	errs := make(chan error, 1)
+	l.errors = errs
+
+	done := make(chan struct{})
+	l.done = done
+
+	forward := func(name string, from <-chan error) {
+		for {
+			select {
+			case err := <-from:
+				if err != nil {
+					report(errs, fmt.Errorf("%s: %w", name, err))
+				}
+			case <-done:
+				return
+			}
+		}
+	}
+
+	go forward("primary", l.primary.Err())
+	for _, s := range l.secondaries {
+		go forward(s.name, s.Err())
+
+		if l.policy == TeePrimary {
+			s.backlog = make(chan []store.Event, teeBacklog)
+			s.done = make(chan struct{})
+			go s.drain(errs)
+		}
+	}
+
+	q := newQueue(16)
+	l.queue = q
+
+	go func() {
+		defer close(q.drained)
+
+		var (
+			group []request
+			ok    bool
+		)
+
+		for {
+			if group, ok = nextGroup(q.requests, group[:0]); !ok {
+				return
+			}
+
+			// Loggers may hold on to the events after LogBatch returns, so
+			// every write gets a slice of its own. Timestamps are set here so
+			// every logger records the same ones. A group is split wherever
+			// it would outgrow a file log record.
+			var (
+				events []store.Event
+				size   int
+				start  int
+			)
+			now := time.Now()
+			flush := func(end int) {
+				err := l.write(events)
+				for _, r := range group[start:end] {
+					r.finish(err)
+				}
+				events, size, start = nil, 0, end
+			}
+
+			for i, r := range group {
+				n := batchSize(r.events)
+				if len(events) > 0 && size+n > maxRecordSize {
+					flush(i)
+				}
+				for _, e := range r.events {
+					if e.Timestamp.IsZero() {
+						e.Timestamp = now
+					}
+					events = append(events, e)
+				}
+				size += n
+			}
+			flush(len(group))
+		}
+	}()
+}
+
+// write hands events to the loggers and returns the error the policy makes
+// of what they said. Under TeePrimary only the primary is waited for.
+func (l *TeeTransactionLogger) write(events []store.Event) error {
+	if l.policy == TeePrimary {
+		if err := l.primary.LogBatch(events); err != nil {
+			return fmt.Errorf("primary: %w", err)
+		}
+		for _, s := range l.secondaries {
+			s.send(events, l.errors)
+		}
+		return nil
+	}
+
+	secondary := make([]error, len(l.secondaries))
+
+	var wg sync.WaitGroup
+	for i, s := range l.secondaries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.LogBatch(events); err != nil {
+				secondary[i] = fmt.Errorf("%s: %w", s.name, err)
+			}
+		}()
+	}
+
+	var primary error
+	if err := l.primary.LogBatch(events); err != nil {
+		primary = fmt.Errorf("primary: %w", err)
+	}
+
+	wg.Wait()
+
+	return errors.Join(append([]error{primary}, secondary...)...)
+}
+
+func (l *TeeTransactionLogger) ReadEvents() (<-chan store.Event, <-chan error) {
+	return l.primary.ReadEvents()
+}
+
+func (l *TeeTransactionLogger) ReadEventsFrom(from store.Sequence) (<-chan store.Event, <-chan error) {
+	return l.primary.ReadEventsFrom(from)
+}
+
+func (l *TeeTransactionLogger) Subscribe() (<-chan store.Event, func()) {
+	return l.primary.Subscribe()
+}
+
+// History looks in the primary, the same way as if it weren't teed.
+func (l *TeeTransactionLogger) History(q HistoryQuery) ([]store.Event, error) {
+	if h, ok := l.primary.(Historian); ok {
+		return h.History(q)
+	}
+	return scanHistory(l.primary, q)
+}
+
+func (l *TeeTransactionLogger) LoadSnapshot() (*store.Snapshot, error) {
+	return l.primary.LoadSnapshot()
+}
+
+func (l *TeeTransactionLogger) Compact(s store.Snapshot) error {
+	return l.primary.Compact(s)
+}
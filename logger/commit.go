@@ -0,0 +1,154 @@
+package logger
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"gitlab.com/linkinlog/cloudKV/store"
+)
+
+// maxGroup caps how many events one group commit takes on.
+const maxGroup = 256
+
+// request is one LogPut, LogDelete or LogBatch call on its way to a writer.
+type request struct {
+	events []store.Event
+	// done receives the outcome once the events are persisted, it is nil
+	// when the caller isn't waiting.
+	done chan error
+}
+
+func (r request) finish(err error) {
+	if r.done != nil {
+		r.done <- err
+	}
+}
+
+// ErrClosed is returned by log calls made after Close.
+var ErrClosed = errors.New("transaction logger closed")
+
+var errNotRunning = errors.New("transaction logger not running")
+
+// queue carries log calls to a writer goroutine, which calls nextGroup or
+// nextBatch on requests and closes drained once they report the queue is
+// closed and empty.
+type queue struct {
+	mu       sync.RWMutex
+	requests chan request
+	closed   bool
+	drained  chan struct{}
+}
+
+func newQueue(size int) *queue {
+	return &queue{
+		requests: make(chan request, size),
+		drained:  make(chan struct{}),
+	}
+}
+
+// submit queues events for the writer, blocking while the queue is full.
+// When durable it also waits until they are persisted and returns the write
+// error, if any.
+func (q *queue) submit(events []store.Event, durable bool) error {
+	if q == nil {
+		return errNotRunning
+	}
+	if len(events) == 0 {
+		return nil
+	}
+
+	r := request{events: events}
+	if durable {
+		r.done = make(chan error, 1)
+	}
+
+	q.mu.RLock()
+	if q.closed {
+		q.mu.RUnlock()
+		return ErrClosed
+	}
+	q.requests <- r
+	q.mu.RUnlock()
+
+	if !durable {
+		return nil
+	}
+	return <-r.done
+}
+
+// close turns away new calls and waits until the writer is done with every
+// call queued before.
+func (q *queue) close() {
+	if q == nil {
+		return
+	}
+
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.requests)
+	}
+	q.mu.Unlock()
+
+	<-q.drained
+}
+
+// nextGroup blocks for one request and then takes whatever else is already
+// queued, so concurrent writers share a single write and sync. It returns
+// false once requests is closed and drained.
+func nextGroup(requests <-chan request, group []request) ([]request, bool) {
+	return nextBatch(requests, group, maxGroup, 0)
+}
+
+// nextBatch is nextGroup for writers that would rather wait up to linger for
+// more requests, stopping early once the group holds size events. A request
+// is never split, so the first one is taken whatever its size.
+func nextBatch(requests <-chan request, group []request, size int, linger time.Duration) ([]request, bool) {
+	r, ok := <-requests
+	if !ok {
+		return group, false
+	}
+	group = append(group, r)
+	n := len(r.events)
+
+	var timeout <-chan time.Time
+	if linger > 0 {
+		timer := time.NewTimer(linger)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for n < size {
+		if timeout == nil {
+			select {
+			case r, ok = <-requests:
+			default:
+				return group, true
+			}
+		} else {
+			select {
+			case r, ok = <-requests:
+			case <-timeout:
+				return group, true
+			}
+		}
+
+		if !ok {
+			return group, true
+		}
+		group = append(group, r)
+		n += len(r.events)
+	}
+
+	return group, true
+}
+
+// report hands err to whoever watches Err without ever blocking the writer,
+// if an error is already waiting there this one is dropped.
+func report(errs chan<- error, err error) {
+	select {
+	case errs <- err:
+	default:
+	}
+}
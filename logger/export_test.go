@@ -0,0 +1,38 @@
+package logger
+
+// NewPostgresTransactionLoggerDSN lets tests point the Postgres logger at a
+// database of their own.
+func NewPostgresTransactionLoggerDSN(dsn string, opts PostgresOptions) (*PostgresTransactionLogger, error) {
+	return openPostgres(dsn, opts)
+}
+
+// Break closes the active segment under the logger, so writes fail.
+func (ftl *FileTransactionLogger) Break() {
+	ftl.mu.Lock()
+	defer ftl.mu.Unlock()
+	_ = ftl.file.Close()
+}
+
+// Break closes the database under the logger, so writes fail.
+func (l *EmbeddedTransactionLogger) Break() {
+	_ = l.db.Close()
+}
+
+// Break closes the connection pool under the logger, so writes fail.
+func (l *PostgresTransactionLogger) Break() {
+	_ = l.db.Close()
+}
+
+// Break breaks the primary, whose failures every policy reports.
+func (l *TeeTransactionLogger) Break() {
+	if b, ok := l.primary.(interface{ Break() }); ok {
+		b.Break()
+	}
+}
+
+// Break breaks the logger underneath.
+func (l *EncryptedTransactionLogger) Break() {
+	if b, ok := l.Logger.(interface{ Break() }); ok {
+		b.Break()
+	}
+}
@@ -0,0 +1,127 @@
+package logger
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"gitlab.com/linkinlog/cloudKV/store"
+)
+
+// ErrWatcherTooSlow ends a watch whose consumer could not keep up with the log.
+// The watch can be resumed from the last sequence it received.
+var ErrWatcherTooSlow = errors.New("watcher fell behind")
+
+const feedBuffer = 64
+
+// feed fans persisted events out to subscribers. A subscriber that lets its
+// buffer fill up is dropped rather than holding up the logger.
+type feed struct {
+	lock sync.Mutex
+	subs map[chan store.Event]struct{}
+}
+
+func (f *feed) Subscribe() (<-chan store.Event, func()) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.subs == nil {
+		f.subs = make(map[chan store.Event]struct{})
+	}
+
+	ch := make(chan store.Event, feedBuffer)
+	f.subs[ch] = struct{}{}
+
+	return ch, func() {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+
+		if _, ok := f.subs[ch]; ok {
+			delete(f.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+func (f *feed) publish(events ...store.Event) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for ch := range f.subs {
+		for _, e := range events {
+			select {
+			case ch <- e:
+				continue
+			default:
+			}
+
+			delete(f.subs, ch)
+			close(ch)
+			break
+		}
+	}
+}
+
+// Watch streams every event with a sequence of at least from, first out of
+// l's history and then live as it is persisted. A from of 0 skips the history.
+// Both channels are closed once ctx is done or the watch fails.
+func Watch(ctx context.Context, l Logger, from store.Sequence) (<-chan store.Event, <-chan error) {
+	outEvent := make(chan store.Event)
+	outError := make(chan error, 1)
+
+	// Subscribe before reading history so nothing written in between is missed,
+	// events seen in both are dropped by sequence.
+	live, cancel := l.Subscribe()
+
+	go func() {
+		defer close(outEvent)
+		defer close(outError)
+		defer cancel()
+
+		var last store.Sequence
+
+		send := func(e store.Event) bool {
+			if e.Sequence <= last {
+				return true
+			}
+			last = e.Sequence
+
+			select {
+			case outEvent <- e:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		if from > 0 {
+			events, errs := l.ReadEventsFrom(from)
+			for e := range events {
+				if !send(e) {
+					return
+				}
+			}
+			if err := <-errs; err != nil {
+				outError <- err
+				return
+			}
+		}
+
+		for {
+			select {
+			case e, ok := <-live:
+				if !ok {
+					outError <- ErrWatcherTooSlow
+					return
+				}
+				if !send(e) {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return outEvent, outError
+}
@@ -0,0 +1,339 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"gitlab.com/linkinlog/cloudKV/store"
+)
+
+// A file log starts with fileHeader and is followed by records. Each record
+// is one write, holding every event of a LogPut, LogDelete or LogBatch call:
+//
+//	uint32  payload length, big endian
+//	uint32  CRC-32C of the payload, big endian (not in version 1 logs)
+//	payload:
+//	  uvarint event count, then for every event
+//	  uvarint sequence
+//	  byte    event type
+//	  varint  expiry in unix nanoseconds, 0 for none
+//	  varint  time logged in unix nanoseconds, 0 if unknown (version 3 on)
+//	  key, value and content type, each as a uvarint length and the raw bytes
+//	  frontend, principal and request ID, the same way (version 4 on)
+//	  uvarint store version, 0 if unknown (version 5 on)
+//
+// Every field is length prefixed, so keys and values may hold any bytes.
+// Segments are only ever appended to in the current version, older ones are
+// read as they are.
+const (
+	fileMagic   = "ckvlog"
+	fileVersion = 5
+
+	// maxRecordSize keeps a corrupt length from allocating the world. Writers
+	// never make a larger one, see CheckBatch.
+	maxRecordSize = 64 << 20
+)
+
+// ErrBatchTooLarge is returned for events too large to log as one batch.
+var ErrBatchTooLarge = fmt.Errorf("batch larger than a %d MiB log record", maxRecordSize>>20)
+
+// CheckBatch fails with ErrBatchTooLarge if events might not fit in one
+// record, even once encrypted. Loggers check every call before taking it,
+// callers that apply a batch to the store before logging it check it first.
+func CheckBatch(events []store.Event) error {
+	if n := batchSize(events); n > maxRecordSize {
+		return fmt.Errorf("%w: %d events of up to %d bytes", ErrBatchTooLarge, len(events), n)
+	}
+	return nil
+}
+
+// batchSize is an upper bound on the payload appendPayload makes of events,
+// allowing for sealed keys and values.
+func batchSize(events []store.Event) int {
+	n := binary.MaxVarintLen64
+	for _, e := range events {
+		n += eventSize(e)
+	}
+	return n
+}
+
+func eventSize(e store.Event) int {
+	// Sequence, type, expiry, timestamp, version and six lengths.
+	n := 11*binary.MaxVarintLen64 + 1
+	n += base64.RawStdEncoding.EncodedLen(len(e.Key)+sealOverhead) + len(e.Value) + sealOverhead
+	return n + len(e.ContentType) + len(e.Frontend) + len(e.Principal) + len(e.RequestID)
+}
+
+var fileHeader = []byte{'c', 'k', 'v', 'l', 'o', 'g', fileVersion, '\n'}
+
+var (
+	errBadRecord       = errors.New("malformed record")
+	errChecksum        = errors.New("record checksum mismatch")
+	errTruncatedHeader = errors.New("truncated transaction log header")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func appendRecord(buf []byte, events []store.Event) []byte {
+	start := len(buf)
+	buf = append(buf, 0, 0, 0, 0, 0, 0, 0, 0)
+
+	buf = appendPayload(buf, events)
+
+	payload := buf[start+8:]
+	binary.BigEndian.PutUint32(buf[start:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[start+4:], crc32.Checksum(payload, crcTable))
+
+	return buf
+}
+
+// appendRecords is appendRecord for events that don't have to be logged as
+// one unit, it splits them over as many records as they need.
+func appendRecords(buf []byte, events []store.Event) ([]byte, error) {
+	for len(events) > 0 {
+		if err := CheckBatch(events[:1]); err != nil {
+			return nil, fmt.Errorf("event %d: %w", events[0].Sequence, err)
+		}
+
+		n, size := 1, batchSize(events[:1])
+		for n < len(events) && size+eventSize(events[n]) <= maxRecordSize {
+			size += eventSize(events[n])
+			n++
+		}
+
+		buf = appendRecord(buf, events[:n])
+		events = events[n:]
+	}
+	return buf, nil
+}
+
+// appendPayload encodes events the way a record holds them, decodeRecord
+// reads them back.
+func appendPayload(buf []byte, events []store.Event) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(events)))
+	for _, e := range events {
+		buf = binary.AppendUvarint(buf, uint64(e.Sequence))
+		buf = append(buf, byte(e.EventType))
+		buf = binary.AppendVarint(buf, toUnixNano(e.Expires))
+		buf = binary.AppendVarint(buf, toUnixNano(e.Timestamp))
+		buf = appendBytes(buf, []byte(e.Key))
+		buf = appendBytes(buf, e.Value)
+		buf = appendBytes(buf, []byte(e.ContentType))
+		buf = appendBytes(buf, []byte(e.Frontend))
+		buf = appendBytes(buf, []byte(e.Principal))
+		buf = appendBytes(buf, []byte(e.RequestID))
+		buf = binary.AppendUvarint(buf, e.Version)
+	}
+	return buf
+}
+
+func appendBytes(buf, b []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+// readRecord returns the events of the next record and its size on disk.
+// It returns io.EOF when r ends cleanly between records, and
+// io.ErrUnexpectedEOF when it ends inside one.
+func readRecord(r io.Reader, version byte) ([]store.Event, int64, error) {
+	frame := 8
+	if version == 1 {
+		frame = 4
+	}
+
+	head := make([]byte, frame)
+	if n, err := io.ReadFull(r, head); err != nil {
+		if n > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+
+	n := binary.BigEndian.Uint32(head)
+	if n > maxRecordSize {
+		return nil, 0, fmt.Errorf("%w: %d byte record", errBadRecord, n)
+	}
+
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+
+	if version > 1 && binary.BigEndian.Uint32(head[4:]) != crc32.Checksum(payload, crcTable) {
+		return nil, 0, errChecksum
+	}
+
+	events, err := decodeRecord(payload, version)
+	return events, int64(frame) + int64(n), err
+}
+
+// decodeRecord reads the events of a payload written in the given version.
+func decodeRecord(payload []byte, version byte) ([]store.Event, error) {
+	p := bytes.NewReader(payload)
+
+	count, err := binary.ReadUvarint(p)
+	if err != nil || count > uint64(len(payload)) {
+		return nil, errBadRecord
+	}
+
+	events := make([]store.Event, 0, count)
+	for range count {
+		var e store.Event
+
+		seq, err := binary.ReadUvarint(p)
+		if err != nil {
+			return nil, errBadRecord
+		}
+		e.Sequence = store.Sequence(seq)
+
+		et, err := p.ReadByte()
+		if err != nil {
+			return nil, errBadRecord
+		}
+		e.EventType = store.EventType(et)
+
+		expires, err := binary.ReadVarint(p)
+		if err != nil {
+			return nil, errBadRecord
+		}
+		e.Expires = fromUnixNano(expires)
+
+		if version >= 3 {
+			logged, err := binary.ReadVarint(p)
+			if err != nil {
+				return nil, errBadRecord
+			}
+			e.Timestamp = fromUnixNano(logged)
+		}
+
+		key, err := readBytes(p)
+		if err != nil {
+			return nil, err
+		}
+		e.Key = string(key)
+
+		if e.Value, err = readBytes(p); err != nil {
+			return nil, err
+		}
+
+		contentType, err := readBytes(p)
+		if err != nil {
+			return nil, err
+		}
+		e.ContentType = string(contentType)
+
+		if version >= 4 {
+			for _, field := range []*string{&e.Frontend, &e.Principal, &e.RequestID} {
+				b, err := readBytes(p)
+				if err != nil {
+					return nil, err
+				}
+				*field = string(b)
+			}
+		}
+
+		if version >= 5 {
+			if e.Version, err = binary.ReadUvarint(p); err != nil {
+				return nil, errBadRecord
+			}
+		}
+
+		events = append(events, e)
+	}
+
+	if p.Len() != 0 {
+		return nil, errBadRecord
+	}
+
+	return events, nil
+}
+
+func readBytes(p *bytes.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(p)
+	if err != nil || n > uint64(p.Len()) {
+		return nil, errBadRecord
+	}
+
+	b := make([]byte, n)
+	_, _ = p.Read(b)
+
+	return b, nil
+}
+
+// legacyVersion is what readVersion reports for logs from before fileHeader existed.
+const legacyVersion = 0
+
+// readVersion consumes the header from r and returns the format version of
+// the log, or legacyVersion if it has no header. Empty logs are current.
+func readVersion(r io.Reader) (byte, error) {
+	header := make([]byte, len(fileHeader))
+	n, err := io.ReadFull(r, header)
+	if n == 0 && errors.Is(err, io.EOF) {
+		return fileVersion, nil
+	}
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return 0, err
+	}
+
+	if n < len(fileHeader) && bytes.HasPrefix(fileHeader, header[:n]) {
+		return 0, errTruncatedHeader
+	}
+
+	if !bytes.HasPrefix(header[:n], []byte(fileMagic)) {
+		return legacyVersion, nil
+	}
+
+	if n < len(fileHeader) || header[len(header)-1] != '\n' {
+		return 0, fmt.Errorf("malformed transaction log header %q", header[:n])
+	}
+
+	version := header[len(fileMagic)]
+	if version < 1 || version > fileVersion {
+		return 0, fmt.Errorf("unsupported transaction log version %d", version)
+	}
+
+	return version, nil
+}
+
+func toUnixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// findRecord returns the offset of the first record in b that checks out and
+// holds events after last, or -1 if there is none.
+func findRecord(b []byte, version byte, last store.Sequence) int {
+	for i := 1; i+8 <= len(b); i++ {
+		n := int(binary.BigEndian.Uint32(b[i:]))
+		if n == 0 || n > len(b)-i-8 {
+			continue
+		}
+
+		payload := b[i+8 : i+8+n]
+		if binary.BigEndian.Uint32(b[i+4:]) != crc32.Checksum(payload, crcTable) {
+			continue
+		}
+		if events, err := decodeRecord(payload, version); err == nil && len(events) > 0 && events[0].Sequence > last {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,149 @@
+package logger
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gitlab.com/linkinlog/cloudKV/store"
+)
+
+// readLegacyEvents parses the tab separated text format the file logger used
+// to write: sequence, type, key and value. That format stored spaces as
+// underscores, so a real underscore comes back as a space and there is no way
+// to tell the two apart anymore.
+func readLegacyEvents(r io.Reader) ([]store.Event, error) {
+	scanner := bufio.NewScanner(r)
+
+	var (
+		events []store.Event
+		last   store.Sequence
+	)
+
+	for scanner.Scan() {
+		var (
+			e     store.Event
+			value string
+		)
+
+		line := scanner.Text()
+
+		line = strings.ReplaceAll(line, " ", "_")
+		// Deletes were written with an empty value, so only the first three
+		// fields are required.
+		n, err := fmt.Sscanf(
+			line, "%d\t%d\t%s\t%s",
+			&e.Sequence, &e.EventType, &e.Key, &value,
+		)
+		if err != nil && (n < 3 || !errors.Is(err, io.EOF)) {
+			return nil, fmt.Errorf("input parse error: %w", err)
+		}
+		e.Key = strings.ReplaceAll(e.Key, "_", " ")
+		if e.EventType != store.EventDelete {
+			e.Value = []byte(strings.ReplaceAll(value, "_", " "))
+		}
+
+		if last >= e.Sequence {
+			return nil, fmt.Errorf("sequence number error: %d >= %d", last, e.Sequence)
+		}
+
+		last = e.Sequence
+
+		events = append(events, e)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("transaction log read failure: %w", err)
+	}
+
+	return events, nil
+}
+
+// upgradeFile rewrites a log in the legacy text format, or an older version of
+// the current one, into the current format, keeping every sequence. The
+// original is kept next to it with a .legacy or .v<version> suffix. Logs
+// already in the current format are left alone.
+func upgradeFile(filename string) error {
+	file, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+
+	version, err := readVersion(r)
+	if errors.Is(err, errTruncatedHeader) {
+		// Nothing was ever logged, there is nothing to upgrade.
+		return nil
+	}
+	if err != nil || version == fileVersion {
+		return err
+	}
+
+	var (
+		records [][]store.Event
+		backup  string
+	)
+
+	if version == legacyVersion {
+		backup = filename + ".legacy"
+
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		events, err := readLegacyEvents(file)
+		if err != nil {
+			return fmt.Errorf("reading legacy log %s: %w", filename, err)
+		}
+
+		for _, e := range events {
+			records = append(records, []store.Event{e})
+		}
+	} else {
+		backup = fmt.Sprintf("%s.v%d", filename, version)
+
+		for {
+			events, _, err := readRecord(r, version)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("reading version %d log %s: %w", version, filename, err)
+			}
+			records = append(records, events)
+		}
+	}
+
+	tmp := filename + ".upgrading"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	buf := append([]byte{}, fileHeader...)
+	for _, events := range records {
+		buf = appendRecord(buf, events)
+	}
+
+	if _, err := out.Write(buf); err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(filename, backup); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filename)
+}
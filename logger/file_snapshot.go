@@ -0,0 +1,120 @@
+package logger
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+
+	"gitlab.com/linkinlog/cloudKV/store"
+)
+
+func (ftl *FileTransactionLogger) snapshotName() string {
+	return ftl.filename + ".snapshot"
+}
+
+// snapshotSequence reads just the sequence a snapshot file covers, 0 if there
+// is no snapshot. LoadSnapshot verifies the rest.
+func snapshotSequence(name string) (store.Sequence, error) {
+	file, err := os.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	head := make([]byte, len(snapshotHeader)+8+binary.MaxVarintLen64)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return 0, err
+	}
+
+	seq, err := parseSnapshotSequence(head[:n])
+	if err != nil {
+		return 0, fmt.Errorf("snapshot %s: %w", name, err)
+	}
+
+	return seq, nil
+}
+
+func (ftl *FileTransactionLogger) LoadSnapshot() (*store.Snapshot, error) {
+	b, err := os.ReadFile(ftl.snapshotName())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := decodeSnapshot(b)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot %s: %w", ftl.snapshotName(), err)
+	}
+
+	return s, nil
+}
+
+// Compact writes s next to the log and then deletes every segment s covers
+// completely. The active segment is rolled over first if s covers it too.
+// Events s covers in the segments that are left are skipped on replay.
+func (ftl *FileTransactionLogger) Compact(s store.Snapshot) error {
+	if s.Sequence < store.Sequence(ftl.compacted.Load()) {
+		return fmt.Errorf("snapshot at sequence %d is older than the current one", s.Sequence)
+	}
+
+	if err := writeFileAtomic(ftl.snapshotName(), encodeSnapshot(s)); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+
+	ftl.mu.Lock()
+	defer ftl.mu.Unlock()
+
+	ftl.compacted.Store(uint64(s.Sequence))
+
+	ftl.catchUp()
+	if ftl.last <= s.Sequence && ftl.size > int64(len(fileHeader)) {
+		if err := ftl.roll(ftl.last + 1); err != nil {
+			return err
+		}
+	}
+
+	// A segment is covered once the next one starts no later than right after s.
+	n := 0
+	for n+1 < len(ftl.segments) && ftl.segments[n+1].start <= s.Sequence+1 {
+		n++
+	}
+
+	for _, seg := range ftl.segments[:n] {
+		if err := os.Remove(seg.name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	ftl.segments = slices.Delete(ftl.segments, 0, n)
+
+	return nil
+}
+
+// writeFileAtomic replaces name with b, so readers see either the old
+// contents or all of the new ones.
+func writeFileAtomic(name string, b []byte) error {
+	tmp := name + ".tmp"
+
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := out.Write(b); err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, name)
+}
@@ -0,0 +1,118 @@
+package logger
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gitlab.com/linkinlog/cloudKV/env"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// FsyncPolicy decides when the file logger asks the OS to flush its writes to disk.
+type FsyncPolicy string
+
+const (
+	// FsyncAlways syncs after every group commit, nothing acknowledged is lost.
+	FsyncAlways FsyncPolicy = "always"
+	// FsyncEverySec syncs from the background once a second, a crash loses at
+	// most the last second of writes.
+	FsyncEverySec FsyncPolicy = "everysec"
+	// FsyncOS never syncs and leaves flushing to the OS.
+	FsyncOS FsyncPolicy = "os"
+)
+
+const fsyncInterval = time.Second
+
+func (p FsyncPolicy) valid() bool {
+	switch p {
+	case FsyncAlways, FsyncEverySec, FsyncOS:
+		return true
+	}
+	return false
+}
+
+var fsyncDuration = sync.OnceValue(func() metric.Float64Histogram {
+	h, _ := otel.Meter(env.ServiceName()).Float64Histogram(
+		"cloudkv_log_fsync_duration_seconds",
+		metric.WithDescription("Time taken to fsync the transaction log."),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(
+			0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1,
+		),
+	)
+	return h
+})
+
+// syncFile syncs file and records how long that took under policy.
+func syncFile(file *os.File, policy FsyncPolicy) error {
+	start := time.Now()
+	err := file.Sync()
+
+	fsyncDuration().Record(context.Background(), time.Since(start).Seconds(),
+		metric.WithAttributes(
+			attribute.String("policy", string(policy)),
+			attribute.Bool("error", err != nil),
+		),
+	)
+
+	return err
+}
+
+// flusher calls sync in the background for FsyncEverySec, skipping ticks
+// with nothing written since the last sync.
+type flusher struct {
+	sync  func() error
+	dirty atomic.Bool
+	stop  chan struct{}
+	done  chan struct{}
+
+	stopOnce sync.Once
+}
+
+func startFlusher(sync func() error, errs chan<- error) *flusher {
+	f := &flusher{
+		sync: sync,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(f.done)
+
+		ticker := time.NewTicker(fsyncInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-f.stop:
+				return
+			case <-ticker.C:
+				if err := f.flush(); err != nil {
+					report(errs, fmt.Errorf("transaction log sync failure: %w", err))
+				}
+			}
+		}
+	}()
+
+	return f
+}
+
+func (f *flusher) flush() error {
+	if !f.dirty.Swap(false) {
+		return nil
+	}
+	return f.sync()
+}
+
+// close stops the flusher and syncs whatever it hadn't gotten to yet.
+func (f *flusher) close() error {
+	f.stopOnce.Do(func() { close(f.stop) })
+	<-f.done
+	return f.flush()
+}
@@ -0,0 +1,49 @@
+package logger
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrDegraded is what Health wraps while a logger can't persist events.
+var ErrDegraded = errors.New("transaction log degraded")
+
+// health tracks whether a logger is keeping up with writes, loggers embed it
+// to implement Health.
+type health struct {
+	mu    sync.Mutex
+	err   error
+	since time.Time
+}
+
+// Health returns nil while the logger is persisting events normally, and an
+// ErrDegraded describing the latest failure otherwise.
+func (h *health) Health() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.err == nil {
+		return nil
+	}
+	return fmt.Errorf("%w since %s: %w", ErrDegraded, h.since.Format(time.RFC3339), h.err)
+}
+
+// degrade records err, keeping the time of the first failure in a row.
+func (h *health) degrade(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.err == nil {
+		h.since = time.Now()
+	}
+	h.err = err
+}
+
+func (h *health) recover() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.err = nil
+}
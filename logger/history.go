@@ -0,0 +1,90 @@
+package logger
+
+import (
+	"errors"
+	"time"
+
+	"gitlab.com/linkinlog/cloudKV/store"
+)
+
+// HistoryQuery picks the events of one key that History returns.
+type HistoryQuery struct {
+	Key string
+	// After skips events up to and including this sequence, pass the last
+	// one of a page to get the next.
+	After store.Sequence
+	// Since and Until keep events logged in [Since, Until), either may be
+	// zero for no bound. Events from before loggers kept timestamps are
+	// left out once either is set.
+	Since time.Time
+	Until time.Time
+	// Limit is the most events to return.
+	Limit int
+}
+
+func (q HistoryQuery) includes(e store.Event) bool {
+	switch {
+	case e.Key != q.Key || e.Sequence <= q.After:
+		return false
+	case (!q.Since.IsZero() || !q.Until.IsZero()) && e.Timestamp.IsZero():
+		return false
+	case !q.Since.IsZero() && e.Timestamp.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && !e.Timestamp.Before(q.Until):
+		return false
+	}
+	return true
+}
+
+// A Historian can look up the events of a key without reading its whole log.
+type Historian interface {
+	// History returns up to q.Limit events matching q, in sequence order.
+	History(q HistoryQuery) ([]store.Event, error)
+}
+
+// History returns the events l still holds for q.Key, oldest first, and
+// whether there are more after them. Loggers that aren't Historians, the
+// file logger among them, have their log scanned.
+func History(l Logger, q HistoryQuery) ([]store.Event, bool, error) {
+	if q.Limit <= 0 {
+		return nil, false, errors.New("history needs a limit")
+	}
+
+	// One more than asked tells whether there are more.
+	q.Limit++
+
+	var (
+		events []store.Event
+		err    error
+	)
+	if h, ok := l.(Historian); ok {
+		events, err = h.History(q)
+	} else {
+		events, err = scanHistory(l, q)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	if more := len(events) == q.Limit; more {
+		return events[:q.Limit-1], true, nil
+	}
+	return events, false, nil
+}
+
+// scanHistory reads the whole of l for the events q matches.
+func scanHistory(l Logger, q HistoryQuery) ([]store.Event, error) {
+	var found []store.Event
+
+	events, errs := l.ReadEvents()
+	for e := range events {
+		if len(found) < q.Limit && q.includes(e) {
+			found = append(found, e)
+		}
+	}
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+
+	return found, nil
+}
@@ -0,0 +1,51 @@
+package logger
+
+import (
+	"fmt"
+
+	"gitlab.com/linkinlog/cloudKV/store"
+)
+
+// An Importer takes in another log as is, keeping its sequences rather than
+// handing out new ones, so snapshots and readers tracking a sequence still
+// line up after moving between backends. It is meant for offline tools: the
+// logger must not be running and its log should be empty.
+type Importer interface {
+	// Import restores s, unless it is nil, and appends events after it. The
+	// events must come in increasing sequence order, after s.
+	Import(s *store.Snapshot, events <-chan store.Event) error
+}
+
+// importChunks hands events to write readChunk at a time, checking each one
+// comes after last. It returns the last sequence written.
+func importChunks(events <-chan store.Event, last store.Sequence, write func([]store.Event) error) (store.Sequence, error) {
+	chunk := make([]store.Event, 0, readChunk)
+
+	flush := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		if err := write(chunk); err != nil {
+			return fmt.Errorf("failed to import events %d to %d: %w", chunk[0].Sequence, last, err)
+		}
+		// Writers may hold on to the events, so the next chunk starts afresh.
+		chunk = make([]store.Event, 0, readChunk)
+		return nil
+	}
+
+	for e := range events {
+		if e.Sequence <= last {
+			return last, fmt.Errorf("can't import sequence %d after %d", e.Sequence, last)
+		}
+		last = e.Sequence
+
+		chunk = append(chunk, e)
+		if len(chunk) == readChunk {
+			if err := flush(); err != nil {
+				return last, err
+			}
+		}
+	}
+
+	return last, flush()
+}
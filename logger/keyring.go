@@ -0,0 +1,200 @@
+package logger
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"gitlab.com/linkinlog/cloudKV/store"
+)
+
+// Sealed data is laid out as:
+//
+//	sealMagic, sealVersion
+//	4 bytes  ID of the key, the start of its SHA-256
+//	nonce
+//	AES-GCM ciphertext and tag
+const (
+	sealMagic   = "ckve"
+	sealVersion = 1
+
+	keyIDSize = 4
+
+	// sealOverhead is what seal adds with a standard AES-GCM nonce and tag.
+	sealOverhead = len(sealMagic) + 1 + keyIDSize + 12 + 16
+)
+
+// errUnknownKey is returned for data sealed with a key the key file no
+// longer has.
+var errUnknownKey = errors.New("sealed with a key that is not in the key file")
+
+type sealKey struct {
+	id   [keyIDSize]byte
+	aead cipher.AEAD
+}
+
+// A keyring holds the keys of a key file. The first one seals, every one of
+// them opens what it sealed.
+type keyring []sealKey
+
+// loadKeyring reads a key file: one base64 encoded 16, 24 or 32 byte AES key
+// per line, newest first. Blank lines and lines starting with # are skipped.
+func loadKeyring(path string) (keyring, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var ring keyring
+
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		raw, err := base64.StdEncoding.DecodeString(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: key isn't base64: %w", path, line, err)
+		}
+
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+
+		k := sealKey{aead: aead}
+		sum := sha256.Sum256(raw)
+		copy(k.id[:], sum[:])
+
+		for _, other := range ring {
+			if other.id == k.id {
+				return nil, fmt.Errorf("%s:%d: key is in the file twice", path, line)
+			}
+		}
+
+		ring = append(ring, k)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(ring) == 0 {
+		return nil, fmt.Errorf("%s has no keys", path)
+	}
+
+	return ring, nil
+}
+
+// seal encrypts plain under the newest key, binding it to ad.
+func (r keyring) seal(plain []byte, ad string) []byte {
+	k := r[0]
+
+	out := make([]byte, 0, len(sealMagic)+1+keyIDSize+k.aead.NonceSize()+len(plain)+k.aead.Overhead())
+	out = append(out, sealMagic...)
+	out = append(out, sealVersion)
+	out = append(out, k.id[:]...)
+
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	out = append(out, nonce...)
+
+	return k.aead.Seal(out, nonce, plain, []byte(ad))
+}
+
+// open decrypts b if seal made it, and reports whether it did. Anything
+// else is returned as is, it was logged before encryption was turned on.
+func (r keyring) open(b []byte, ad string) ([]byte, bool, error) {
+	head := len(sealMagic) + 1 + keyIDSize
+	if len(b) < head || string(b[:len(sealMagic)]) != sealMagic || b[len(sealMagic)] != sealVersion {
+		return b, false, nil
+	}
+
+	id := b[len(sealMagic)+1 : head]
+	for _, k := range r {
+		if !bytes.Equal(k.id[:], id) {
+			continue
+		}
+
+		rest := b[head:]
+		if len(rest) < k.aead.NonceSize() {
+			return nil, true, errBadRecord
+		}
+
+		plain, err := k.aead.Open([]byte{}, rest[:k.aead.NonceSize()], rest[k.aead.NonceSize():], []byte(ad))
+		if err != nil {
+			return nil, true, fmt.Errorf("failed to decrypt: %w", err)
+		}
+		return plain, true, nil
+	}
+
+	return nil, true, fmt.Errorf("%w: key %x", errUnknownKey, id)
+}
+
+// Keys are strings, and some loggers keep them as text, so sealed keys are
+// base64 encoded.
+func (r keyring) sealKey(key string) string {
+	return base64.RawStdEncoding.EncodeToString(r.seal([]byte(key), "key"))
+}
+
+func (r keyring) openKey(key string) (string, error) {
+	b, err := base64.RawStdEncoding.DecodeString(key)
+	if err != nil {
+		return key, nil
+	}
+
+	plain, sealed, err := r.open(b, "key")
+	if !sealed {
+		return key, nil
+	}
+	return string(plain), err
+}
+
+// Values are bound to their key, so they can't be swapped between keys.
+func (r keyring) sealValue(key string, value []byte) []byte {
+	return r.seal(value, "value:"+key)
+}
+
+func (r keyring) openValue(key string, value []byte) ([]byte, error) {
+	plain, _, err := r.open(value, "value:"+key)
+	return plain, err
+}
+
+func (r keyring) sealEvent(e store.Event) store.Event {
+	if e.EventType == store.EventPut {
+		e.Value = r.sealValue(e.Key, e.Value)
+	}
+	e.Key = r.sealKey(e.Key)
+	return e
+}
+
+func (r keyring) openEvent(e store.Event) (store.Event, error) {
+	key, err := r.openKey(e.Key)
+	if err != nil {
+		return e, err
+	}
+	e.Key = key
+
+	if e.EventType == store.EventPut {
+		if e.Value, err = r.openValue(key, e.Value); err != nil {
+			return e, err
+		}
+	}
+
+	return e, nil
+}
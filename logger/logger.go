@@ -2,28 +2,78 @@ package logger
 
 import (
 	"fmt"
+	"time"
 
 	"gitlab.com/linkinlog/cloudKV/env"
 	"gitlab.com/linkinlog/cloudKV/store"
 )
 
+// Log calls queue their events and return straight away, write failures only
+// show up on Err. In durable mode they block until the events are persisted
+// and return the write error instead.
 type Logger interface {
-	LogPut(key, value string) error
+	// LogPut records a put, expires is zero for keys that never expire.
+	LogPut(key string, value []byte, contentType string, expires time.Time) error
 	LogDelete(key string) error
+	// LogBatch records events as one unit, ReadEvents yields all of them or none.
+	LogBatch(events []store.Event) error
 
+	// Close waits until every call made before it is persisted, or has
+	// failed, and then releases the log. Calls after Close fail with ErrClosed.
 	Close() error
 
 	Err() <-chan error
+	// Health returns nil while events are being persisted, and an error
+	// wrapping ErrDegraded while they can't be.
+	Health() error
 
 	ReadEvents() (<-chan store.Event, <-chan error)
+	// ReadEventsFrom reads the events with a sequence of at least from, it is
+	// safe to call while the logger is running.
+	ReadEventsFrom(from store.Sequence) (<-chan store.Event, <-chan error)
+
+	// Subscribe streams events once they are persisted until the returned func
+	// is called. The channel is closed early if the subscriber falls behind.
+	Subscribe() (<-chan store.Event, func())
+
+	// LoadSnapshot returns the latest snapshot, or nil if none was taken yet.
+	LoadSnapshot() (*store.Snapshot, error)
+	// Compact saves s as the latest snapshot and drops the events it covers,
+	// ReadEventsFrom fails with ErrCompacted for those afterwards.
+	Compact(s store.Snapshot) error
 
 	Run()
 }
 
-func New(l LoggerType) (Logger, error) {
+type Options struct {
+	File     FileOptions
+	PSQL     PostgresOptions
+	Embedded EmbeddedOptions
+	Tee      TeeOptions
+
+	Encryption EncryptionOptions
+}
+
+// New opens a logger of type l, encrypting it if opts ask for it.
+func New(l LoggerType, opts Options) (Logger, error) {
+	inner, err := newLogger(l, opts)
+	if err != nil || opts.Encryption.KeyFile == "" {
+		return inner, err
+	}
+
+	encrypted, err := NewEncryptedTransactionLogger(inner, opts.Encryption)
+	if err != nil {
+		_ = inner.Close()
+		return nil, err
+	}
+
+	return encrypted, nil
+}
+
+func newLogger(l LoggerType, opts Options) (Logger, error) {
 	switch l {
 	case File:
-		return NewFileTransactionLogger(env.ConfigPath() + "/data")
+		return NewFileTransactionLogger(env.ConfigPath()+"/data", opts.File)
 	case PSQL:
 		params := PostgresDBParams{
 			dbName:   env.DBName(),
@@ -32,7 +82,13 @@ func New(l LoggerType) (Logger, error) {
 			password: env.DBPass(),
 		}
 
-		return NewPostgresTransactionLogger(params)
+		return NewPostgresTransactionLogger(params, opts.PSQL)
+	case Embedded:
+		return NewEmbeddedTransactionLogger(env.ConfigPath()+"/data.db", opts.Embedded)
+	case Memory:
+		return NewMemoryTransactionLogger(), nil
+	case Tee:
+		return newTee(opts)
 	}
 	return nil, fmt.Errorf("invalid loggerType %v", l)
 }
@@ -43,6 +99,12 @@ func ToLoggerType(s string) LoggerType {
 		return File
 	case "PSQL":
 		return PSQL
+	case "Embedded":
+		return Embedded
+	case "Memory":
+		return Memory
+	case "Tee":
+		return Tee
 	}
 	return 0
 }
@@ -53,8 +115,11 @@ const (
 	_ LoggerType = iota
 	File
 	PSQL
+	Embedded
+	Memory
+	Tee
 )
 
 func (l LoggerType) String() string {
-	return []string{"File", "PSQL"}[l-1]
+	return []string{"File", "PSQL", "Embedded", "Memory", "Tee"}[l-1]
 }
@@ -0,0 +1,873 @@
+package logger_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.com/linkinlog/cloudKV/logger"
+	"gitlab.com/linkinlog/cloudKV/logger/loggertest"
+	"gitlab.com/linkinlog/cloudKV/store"
+)
+
+func TestMemory(t *testing.T) {
+	loggertest.Run(t, func(t *testing.T) func() logger.Logger {
+		l := logger.NewMemoryTransactionLogger()
+		return func() logger.Logger { return l.Reopen() }
+	})
+}
+
+func TestFile(t *testing.T) {
+	for name, opts := range map[string]logger.FileOptions{
+		"default":   {},
+		"durable":   {Durable: true},
+		"everysec":  {Durable: true, Fsync: logger.FsyncEverySec},
+		"segmented": {SegmentSize: 512},
+	} {
+		t.Run(name, func(t *testing.T) {
+			loggertest.Run(t, func(t *testing.T) func() logger.Logger {
+				filename := filepath.Join(t.TempDir(), "data")
+				return func() logger.Logger {
+					l, err := logger.NewFileTransactionLogger(filename, opts)
+					if err != nil {
+						t.Fatal(err)
+					}
+					return l
+				}
+			})
+		})
+	}
+}
+
+// TestFileDamagedTail cuts the last record of a file log short or breaks
+// its checksum, and checks the log refuses to open in strict mode and
+// otherwise drops just that record and reports it.
+func TestFileDamagedTail(t *testing.T) {
+	for name, damage := range map[string]func(b []byte) []byte{
+		"truncated": func(b []byte) []byte { return b[:len(b)-3] },
+		"checksum": func(b []byte) []byte {
+			b[len(b)-2] ^= 0xff
+			return b
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "data")
+
+			l, err := logger.NewFileTransactionLogger(filename, logger.FileOptions{Durable: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			l.Run()
+			for _, v := range []string{"1", "2", "3"} {
+				if err := l.LogPut("key", []byte(v), "", time.Time{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := l.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			segments, err := filepath.Glob(filename + ".*")
+			if err != nil || len(segments) != 1 {
+				t.Fatalf("found segments %v, %v", segments, err)
+			}
+			b, err := os.ReadFile(segments[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			damaged := damage(b)
+			if err := os.WriteFile(segments[0], damaged, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = logger.NewFileTransactionLogger(filename, logger.FileOptions{Strict: true})
+			if !errors.Is(err, logger.ErrDamagedTail) {
+				t.Fatalf("strict open returned %v, want %v", err, logger.ErrDamagedTail)
+			}
+			if after, _ := os.ReadFile(segments[0]); !bytes.Equal(after, damaged) {
+				t.Error("strict open changed the log")
+			}
+
+			l, err = logger.NewFileTransactionLogger(filename, logger.FileOptions{Durable: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			events := collectEvents(t, l)
+			if len(events) != 2 || string(events[1].Value) != "2" || events[1].Sequence != 2 {
+				t.Fatalf("replayed %+v, want the first two puts", events)
+			}
+
+			l.Run()
+			select {
+			case err := <-l.Err():
+				if !errors.Is(err, logger.ErrDamagedTail) {
+					t.Errorf("Err reported %v, want %v", err, logger.ErrDamagedTail)
+				}
+			case <-time.After(time.Second):
+				t.Error("the damaged tail wasn't reported")
+			}
+
+			if err := l.LogPut("key", []byte("4"), "", time.Time{}); err != nil {
+				t.Fatal(err)
+			}
+			if err := l.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			l, err = logger.NewFileTransactionLogger(filename, logger.FileOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			events = collectEvents(t, l)
+			if last := events[len(events)-1]; len(events) != 3 || last.Sequence != 3 || string(last.Value) != "4" {
+				t.Errorf("replayed %+v after writing past the cut", events)
+			}
+		})
+	}
+}
+
+// TestFileCorruptMiddle breaks the first record of a file log and checks it
+// won't open either way, rather than dropping the good records after it.
+func TestFileCorruptMiddle(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "data")
+
+	l, err := logger.NewFileTransactionLogger(filename, logger.FileOptions{Durable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Run()
+	for _, v := range []string{"1", "2", "3"} {
+		if err := l.LogPut("key", []byte(v), "", time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	segments, err := filepath.Glob(filename + ".*")
+	if err != nil || len(segments) != 1 {
+		t.Fatalf("found segments %v, %v", segments, err)
+	}
+	b, err := os.ReadFile(segments[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Past the file header and the first record's length and checksum.
+	b[8+8+1] ^= 0xff
+	if err := os.WriteFile(segments[0], b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, strict := range []bool{false, true} {
+		_, err := logger.NewFileTransactionLogger(filename, logger.FileOptions{Strict: strict})
+		if !errors.Is(err, logger.ErrCorruptLog) {
+			t.Errorf("strict %v: open returned %v, want %v", strict, err, logger.ErrCorruptLog)
+		}
+	}
+	if after, _ := os.ReadFile(segments[0]); !bytes.Equal(after, b) {
+		t.Error("opening changed the log")
+	}
+}
+
+// TestFileBatchTooLarge checks a file log turns away what it couldn't read
+// back, and that a tee doesn't merge calls into a record that large.
+func TestFileBatchTooLarge(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "data")
+	open := func() *logger.FileTransactionLogger {
+		l, err := logger.NewFileTransactionLogger(filename, logger.FileOptions{Durable: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+
+	file := open()
+	l, err := logger.NewTeeTransactionLogger(logger.TeePrimary, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Run()
+
+	if err := file.LogPut("huge", make([]byte, 65<<20), "", time.Time{}); !errors.Is(err, logger.ErrBatchTooLarge) {
+		t.Errorf("file LogPut of 65 MiB returned %v, want %v", err, logger.ErrBatchTooLarge)
+	}
+	if err := l.LogPut("huge", make([]byte, 65<<20), "", time.Time{}); !errors.Is(err, logger.ErrBatchTooLarge) {
+		t.Errorf("tee LogPut of 65 MiB returned %v, want %v", err, logger.ErrBatchTooLarge)
+	}
+
+	// Calls that queue up together are written together, unless that would
+	// make too large a record.
+	const writers = 8
+	value := make([]byte, 10<<20)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if err := l.LogPut(fmt.Sprint(i), value, "", time.Time{}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file = open()
+	defer file.Close()
+	if events := collectEvents(t, file); len(events) != writers {
+		t.Errorf("replayed %d events, want %d", len(events), writers)
+	}
+}
+
+// TestFileLegacy opens a log in the tab separated format the file logger
+// first wrote, and checks it is upgraded with its sequences and a backup kept.
+func TestFileLegacy(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "data")
+
+	// Deletes were written with an empty value, which leaves a trailing tab.
+	legacy := "1\t2\tgreeting\thello_world\n" +
+		"2\t2\tother\tvalue\n" +
+		"3\t1\tgreeting\t\n" +
+		"4\t2\tgreeting\tback\n"
+	if err := os.WriteFile(filename, []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := logger.NewFileTransactionLogger(filename, logger.FileOptions{Durable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []store.Event{
+		{Sequence: 1, EventType: store.EventPut, Key: "greeting", Value: []byte("hello world")},
+		{Sequence: 2, EventType: store.EventPut, Key: "other", Value: []byte("value")},
+		{Sequence: 3, EventType: store.EventDelete, Key: "greeting"},
+		{Sequence: 4, EventType: store.EventPut, Key: "greeting", Value: []byte("back")},
+	}
+	got := collectEvents(t, l)
+	if len(got) != len(want) {
+		t.Fatalf("replayed %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i].Sequence != want[i].Sequence || got[i].EventType != want[i].EventType ||
+			got[i].Key != want[i].Key || !bytes.Equal(got[i].Value, want[i].Value) {
+			t.Errorf("event %d is %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	l.Run()
+	if err := l.LogPut("greeting", []byte("again"), "", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err := os.ReadFile(filename + ".legacy"); err != nil || string(b) != legacy {
+		t.Errorf("legacy log wasn't kept as it was: %v", err)
+	}
+
+	l, err = logger.NewFileTransactionLogger(filename, logger.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	got = collectEvents(t, l)
+	if last := got[len(got)-1]; len(got) != 5 || last.Sequence != 5 || string(last.Value) != "again" {
+		t.Errorf("replayed %+v after the upgrade, want sequences to carry on at 5", got)
+	}
+}
+
+func TestEmbedded(t *testing.T) {
+	for name, opts := range map[string]logger.EmbeddedOptions{
+		"default": {},
+		"durable": {Durable: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			loggertest.Run(t, func(t *testing.T) func() logger.Logger {
+				filename := filepath.Join(t.TempDir(), "data.db")
+				return func() logger.Logger {
+					l, err := logger.NewEmbeddedTransactionLogger(filename, opts)
+					if err != nil {
+						t.Fatal(err)
+					}
+					return l
+				}
+			})
+		})
+	}
+}
+
+// TestPostgres only runs when CLOUDKV_TEST_PG_DSN names a database to test
+// against, in any format lib/pq takes. Every test gets a schema of its own
+// there, dropped once it is done, so nothing else in the database is touched.
+func TestPostgres(t *testing.T) {
+	dsn := os.Getenv("CLOUDKV_TEST_PG_DSN")
+	if dsn == "" {
+		t.Skip("set CLOUDKV_TEST_PG_DSN to test against Postgres")
+	}
+
+	loggertest.Run(t, func(t *testing.T) func() logger.Logger {
+		dsn := postgresSchema(t, dsn)
+		return func() logger.Logger {
+			l, err := logger.NewPostgresTransactionLoggerDSN(dsn, logger.PostgresOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return l
+		}
+	})
+}
+
+// TestPostgresBadEvent checks a call Postgres turns down only fails itself,
+// not the others written in the same transaction.
+func TestPostgresBadEvent(t *testing.T) {
+	dsn := os.Getenv("CLOUDKV_TEST_PG_DSN")
+	if dsn == "" {
+		t.Skip("set CLOUDKV_TEST_PG_DSN to test against Postgres")
+	}
+
+	opts := logger.PostgresOptions{Durable: true, FlushInterval: logger.Duration(100 * time.Millisecond)}
+	l, err := logger.NewPostgresTransactionLoggerDSN(postgresSchema(t, dsn), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Run()
+	defer l.Close()
+
+	// Text can't hold a NUL, so Postgres rejects the key.
+	keys := []string{"a", "bad\x00key", "b", "c"}
+	errs := make([]error, len(keys))
+	var wg sync.WaitGroup
+	for i, key := range keys {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = l.LogPut(key, []byte("value"), "", time.Time{})
+		}()
+	}
+	wg.Wait()
+
+	for i, key := range keys {
+		if bad := strings.Contains(key, "\x00"); bad != (errs[i] != nil) {
+			t.Errorf("LogPut(%q) returned %v", key, errs[i])
+		}
+	}
+}
+
+// postgresSchema creates a schema for t, drops it when t is done, and
+// returns dsn with it as the search path.
+func postgresSchema(t *testing.T, dsn string) string {
+	t.Helper()
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	schema := fmt.Sprintf("cloudkv_test_%d", time.Now().UnixNano())
+	if _, err := db.Exec(`create schema ` + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db, err := sql.Open("postgres", dsn)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer db.Close()
+		if _, err := db.Exec(`drop schema ` + schema + ` cascade`); err != nil {
+			t.Error(err)
+		}
+	})
+
+	if u, err := url.Parse(dsn); err == nil && u.Scheme != "" {
+		q := u.Query()
+		q.Set("search_path", schema)
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+	return dsn + " search_path=" + schema
+}
+
+func TestTee(t *testing.T) {
+	loggertest.Run(t, func(t *testing.T) func() logger.Logger {
+		dir := t.TempDir()
+		return func() logger.Logger {
+			primary, err := logger.NewFileTransactionLogger(filepath.Join(dir, "data"), logger.FileOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			secondary, err := logger.NewEmbeddedTransactionLogger(filepath.Join(dir, "data.db"), logger.EmbeddedOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			l, err := logger.NewTeeTransactionLogger(logger.TeeAll, primary, secondary)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return l
+		}
+	})
+}
+
+func TestTeeSecondary(t *testing.T) {
+	primary := logger.NewMemoryTransactionLogger()
+	secondary := logger.NewMemoryTransactionLogger()
+
+	l, err := logger.NewTeeTransactionLogger(logger.TeeAll, primary.Reopen(), secondary.Reopen())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Run()
+
+	var wg sync.WaitGroup
+	for w := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 50 {
+				if err := l.LogPut("key", []byte(fmt.Sprintf("%d.%d", w, i)), "", time.Time{}); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(l logger.Logger) []string {
+		events, errs := l.ReadEvents()
+		var values []string
+		for e := range events {
+			values = append(values, string(e.Value))
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+		return values
+	}
+
+	want, got := read(primary), read(secondary)
+	if len(want) != 200 {
+		t.Fatalf("primary logged %d events, want 200", len(want))
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("secondary logged events in a different order from the primary")
+	}
+}
+
+func TestTeePolicy(t *testing.T) {
+	for _, test := range []struct {
+		policy  logger.TeePolicy
+		wantErr bool
+	}{
+		{logger.TeeAll, true},
+		{logger.TeePrimary, false},
+	} {
+		t.Run(string(test.policy), func(t *testing.T) {
+			broken := logger.NewMemoryTransactionLogger()
+			_ = broken.Close()
+
+			l, err := logger.NewTeeTransactionLogger(test.policy, logger.NewMemoryTransactionLogger(), broken)
+			if err != nil {
+				t.Fatal(err)
+			}
+			l.Run()
+			defer l.Close()
+
+			err = l.LogPut("key", []byte("value"), "", time.Time{})
+			if got := errors.Is(err, logger.ErrClosed); got != test.wantErr {
+				t.Fatalf("LogPut returned %v", err)
+			}
+
+			if !test.wantErr {
+				select {
+				case err := <-l.Err():
+					if !errors.Is(err, logger.ErrClosed) {
+						t.Errorf("Err reported %v, want %v", err, logger.ErrClosed)
+					}
+				case <-time.After(time.Second):
+					t.Error("the secondary's failure wasn't reported")
+				}
+			}
+		})
+	}
+}
+
+// stuckLogger blocks in LogBatch until unblock is closed.
+type stuckLogger struct {
+	*logger.MemoryTransactionLogger
+	unblock chan struct{}
+}
+
+func (l stuckLogger) LogBatch(events []store.Event) error {
+	<-l.unblock
+	return l.MemoryTransactionLogger.LogBatch(events)
+}
+
+func TestTeeStuckSecondary(t *testing.T) {
+	primary := logger.NewMemoryTransactionLogger()
+	secondary := stuckLogger{logger.NewMemoryTransactionLogger(), make(chan struct{})}
+
+	l, err := logger.NewTeeTransactionLogger(logger.TeePrimary, primary.Reopen(), secondary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Run()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range 200 {
+			if err := l.LogPut("key", []byte(fmt.Sprint(i)), "", time.Time{}); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the primary was held up by a stuck secondary")
+	}
+
+	if err := l.Health(); !errors.Is(err, logger.ErrDegraded) {
+		t.Errorf("Health returned %v, want %v", err, logger.ErrDegraded)
+	}
+	select {
+	case err := <-l.Err():
+		if err == nil {
+			t.Error("Err reported nil")
+		}
+	case <-time.After(time.Second):
+		t.Error("the secondary falling behind wasn't reported")
+	}
+
+	close(secondary.unblock)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	events, errs := primary.ReadEvents()
+	n := 0
+	for range events {
+		n++
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if n != 200 {
+		t.Errorf("primary logged %d events, want 200", n)
+	}
+}
+
+func TestImport(t *testing.T) {
+	for name, open := range map[string]func(t *testing.T) logger.Logger{
+		"memory": func(t *testing.T) logger.Logger {
+			return logger.NewMemoryTransactionLogger()
+		},
+		"file": func(t *testing.T) logger.Logger {
+			l, err := logger.NewFileTransactionLogger(filepath.Join(t.TempDir(), "data"), logger.FileOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return l
+		},
+		"embedded": func(t *testing.T) logger.Logger {
+			l, err := logger.NewEmbeddedTransactionLogger(filepath.Join(t.TempDir(), "data.db"), logger.EmbeddedOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return l
+		},
+	} {
+		for _, seqs := range [][]store.Sequence{{12, 15, 20}, nil} {
+			t.Run(fmt.Sprintf("%s/%d events", name, len(seqs)), func(t *testing.T) {
+				l := open(t)
+				defer l.Close()
+
+				snap := &store.Snapshot{
+					Sequence: 10,
+					Rev:      3,
+					Entries:  []store.KeyValue{{Key: "a", Value: []byte("1"), Version: 3}},
+				}
+
+				events := make(chan store.Event, len(seqs))
+				for _, seq := range seqs {
+					events <- store.Event{Sequence: seq, EventType: store.EventPut, Key: "b", Value: []byte("2")}
+				}
+				close(events)
+
+				if err := l.(logger.Importer).Import(snap, events); err != nil {
+					t.Fatal(err)
+				}
+
+				got, err := l.LoadSnapshot()
+				if err != nil || got == nil || got.Sequence != snap.Sequence {
+					t.Fatalf("LoadSnapshot returned %+v, %v", got, err)
+				}
+
+				read, errs := l.ReadEventsFrom(snap.Sequence + 1)
+				var gotSeqs []store.Sequence
+				for e := range read {
+					gotSeqs = append(gotSeqs, e.Sequence)
+				}
+				if err := <-errs; err != nil {
+					t.Fatal(err)
+				}
+				if !slices.Equal(gotSeqs, seqs) {
+					t.Fatalf("imported sequences %v, want %v", gotSeqs, seqs)
+				}
+
+				l.Run()
+
+				live, cancel := l.Subscribe()
+				defer cancel()
+
+				if err := l.LogPut("c", []byte("3"), "", time.Time{}); err != nil {
+					t.Fatal(err)
+				}
+
+				want := snap.Sequence + 1
+				if len(seqs) > 0 {
+					want = seqs[len(seqs)-1] + 1
+				}
+				select {
+				case e := <-live:
+					if e.Sequence != want {
+						t.Errorf("logged sequence %d after importing, want %d", e.Sequence, want)
+					}
+				case <-time.After(time.Second):
+					t.Fatal("the event logged after importing wasn't persisted")
+				}
+			})
+		}
+	}
+}
+
+// writeKeys writes a key file holding keys, in order, and returns its path.
+func writeKeys(t *testing.T, dir string, keys ...[]byte) string {
+	t.Helper()
+
+	var b strings.Builder
+	b.WriteString("# newest first\n")
+	for _, k := range keys {
+		b.WriteString(base64.StdEncoding.EncodeToString(k) + "\n")
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("keys-%d", len(keys)))
+	if err := os.WriteFile(path, []byte(b.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newKey() []byte {
+	k := make([]byte, 32)
+	_, _ = rand.Read(k)
+	return k
+}
+
+func TestEncrypted(t *testing.T) {
+	loggertest.Run(t, func(t *testing.T) func() logger.Logger {
+		dir := t.TempDir()
+		keys := writeKeys(t, dir, newKey())
+		return func() logger.Logger {
+			inner, err := logger.NewFileTransactionLogger(filepath.Join(dir, "data"), logger.FileOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			l, err := logger.NewEncryptedTransactionLogger(inner, logger.EncryptionOptions{KeyFile: keys})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return l
+		}
+	})
+}
+
+// TestEncryptedAtRest checks keys and values never reach the disk in the
+// clear, and that events from before encryption was turned on still read.
+func TestEncryptedAtRest(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "data")
+	keys := writeKeys(t, dir, newKey())
+
+	open := func(encrypted bool) logger.Logger {
+		inner, err := logger.NewFileTransactionLogger(filename, logger.FileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !encrypted {
+			return inner
+		}
+		l, err := logger.NewEncryptedTransactionLogger(inner, logger.EncryptionOptions{KeyFile: keys})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+
+	write := func(l logger.Logger, events ...store.Event) {
+		for range collectEvents(t, l) {
+		}
+		l.Run()
+		if err := l.LogBatch(events); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(open(false), store.Event{EventType: store.EventPut, Key: "plain-key", Value: []byte("plain-value")})
+	write(open(true),
+		store.Event{EventType: store.EventPut, Key: "secret-key", Value: []byte("secret-value")},
+		store.Event{EventType: store.EventDelete, Key: "plain-key"},
+	)
+
+	files, err := filepath.Glob(filename + "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(b, []byte("secret")) {
+			t.Errorf("%s holds a secret in the clear", f)
+		}
+	}
+
+	got := collectEvents(t, open(true))
+	want := []string{"put plain-key plain-value", "put secret-key secret-value", "delete plain-key "}
+	if len(got) != len(want) {
+		t.Fatalf("read %d events, want %d", len(got), len(want))
+	}
+	for i, e := range got {
+		op := "put"
+		if e.EventType == store.EventDelete {
+			op = "delete"
+		}
+		if s := fmt.Sprintf("%s %s %s", op, e.Key, e.Value); s != want[i] {
+			t.Errorf("read %q, want %q", s, want[i])
+		}
+	}
+}
+
+// TestEncryptedRotation rotates to a new key, compacts, and then drops the
+// old key.
+func TestEncryptedRotation(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "data")
+	oldKey, newKey := newKey(), newKey()
+
+	open := func(keys ...[]byte) logger.Logger {
+		inner, err := logger.NewFileTransactionLogger(filename, logger.FileOptions{Durable: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := logger.NewEncryptedTransactionLogger(inner, logger.EncryptionOptions{KeyFile: writeKeys(t, dir, keys...)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for range collectEvents(t, l) {
+		}
+		l.Run()
+		return l
+	}
+
+	l := open(oldKey)
+	for i := range 3 {
+		if err := l.LogPut(fmt.Sprint("key-", i), []byte(fmt.Sprint(i)), "", time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = l.Close()
+
+	// Rotated: the old key still decrypts, compaction re-encrypts.
+	l = open(newKey, oldKey)
+	kv := store.New(false)
+	var last store.Sequence
+	for _, e := range collectEvents(t, l) {
+		if _, err := kv.Put(e.Key, e.Value); err != nil {
+			t.Fatal(err)
+		}
+		last = e.Sequence
+	}
+	// Logged first so the segment is only partly compacted, and the events
+	// under the old key linger in it.
+	if err := l.LogPut("after", []byte("rotation"), "", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Compact(kv.Snapshot(last)); err != nil {
+		t.Fatal(err)
+	}
+	_ = l.Close()
+
+	// The old key is gone, but nothing the log still needs was under it.
+	l = open(newKey)
+	defer l.Close()
+
+	snap, err := l.LoadSnapshot()
+	if err != nil {
+		t.Fatalf("LoadSnapshot: %v", err)
+	}
+	if snap == nil || len(snap.Entries) != 3 || snap.Entries[0].Key != "key-0" || string(snap.Entries[2].Value) != "2" {
+		t.Fatalf("LoadSnapshot returned %+v", snap)
+	}
+
+	var after []store.Event
+	for _, e := range collectEvents(t, l) {
+		if e.Sequence > snap.Sequence {
+			after = append(after, e)
+		}
+	}
+	if len(after) != 1 || after[0].Key != "after" || string(after[0].Value) != "rotation" {
+		t.Errorf("read %+v after the snapshot", after)
+	}
+}
+
+func collectEvents(t *testing.T, l logger.Logger) []store.Event {
+	t.Helper()
+
+	events, errs := l.ReadEvents()
+	var out []store.Event
+	for e := range events {
+		out = append(out, e)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("ReadEvents: %v", err)
+	}
+	return out
+}
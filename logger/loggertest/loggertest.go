@@ -0,0 +1,597 @@
+// Package loggertest checks that a logger.Logger behaves the way the rest of
+// cloudKV relies on: ordering, replay after reopening, Err, failures and
+// Close.
+package loggertest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.com/linkinlog/cloudKV/logger"
+	"gitlab.com/linkinlog/cloudKV/store"
+)
+
+// Factory sets up a log for one test and returns how to open it. Every logger
+// open returns must be over that same log, so what one persisted is there for
+// the next. The log doesn't have to start out empty, the tests only look at
+// what they add to it.
+type Factory func(t *testing.T) (open func() logger.Logger)
+
+// Run runs every conformance test against the loggers factory sets up.
+func Run(t *testing.T, factory Factory) {
+	t.Run("Ordering", func(t *testing.T) { testOrdering(t, factory(t)) })
+	t.Run("Replay", func(t *testing.T) { testReplay(t, factory(t)) })
+	t.Run("Err", func(t *testing.T) { testErr(t, factory(t)) })
+	t.Run("Failure", func(t *testing.T) { testFailure(t, factory(t)) })
+	t.Run("Close", func(t *testing.T) { testClose(t, factory(t)) })
+	t.Run("Compact", func(t *testing.T) { testCompact(t, factory(t)) })
+	t.Run("History", func(t *testing.T) { testHistory(t, factory(t)) })
+}
+
+// timeout bounds every wait on a logger, so a broken one fails rather than hangs.
+const timeout = 10 * time.Second
+
+// start opens a logger the way the service does, replaying it before running
+// it. It returns the logger, the events it replayed and the last sequence the
+// log has handed out.
+func start(t *testing.T, open func() logger.Logger) (logger.Logger, []store.Event, store.Sequence) {
+	t.Helper()
+
+	l := open()
+
+	snap, err := l.LoadSnapshot()
+	if err != nil {
+		t.Fatalf("LoadSnapshot: %v", err)
+	}
+
+	var last store.Sequence
+	if snap != nil {
+		last = snap.Sequence
+	}
+
+	events, err := collect(l.ReadEvents())
+	if err != nil {
+		t.Fatalf("ReadEvents: %v", err)
+	}
+	for _, e := range events {
+		last = max(last, e.Sequence)
+	}
+
+	l.Run()
+
+	return l, events, last
+}
+
+func collect(events <-chan store.Event, errs <-chan error) ([]store.Event, error) {
+	var out []store.Event
+	for e := range events {
+		out = append(out, e)
+	}
+	return out, <-errs
+}
+
+func after(events []store.Event, seq store.Sequence) []store.Event {
+	var out []store.Event
+	for _, e := range events {
+		if e.Sequence > seq {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// persisted runs log and waits until n events it logged come through a
+// subscription, which only sees events once they are persisted.
+func persisted(t *testing.T, l logger.Logger, n int, log func()) []store.Event {
+	t.Helper()
+
+	live, cancel := l.Subscribe()
+	defer cancel()
+
+	log()
+
+	var out []store.Event
+	deadline := time.After(timeout)
+	for len(out) < n {
+		select {
+		case e, ok := <-live:
+			if !ok {
+				t.Fatalf("subscription closed after %d of %d events", len(out), n)
+			}
+			out = append(out, e)
+		case <-deadline:
+			t.Fatalf("only %d of %d events persisted", len(out), n)
+		}
+	}
+
+	return out
+}
+
+func sameEvent(a, b store.Event) bool {
+	return a.EventType == b.EventType &&
+		a.Key == b.Key &&
+		bytes.Equal(a.Value, b.Value) &&
+		a.ContentType == b.ContentType &&
+		a.Expires.Equal(b.Expires) &&
+		a.Version == b.Version &&
+		a.Origin == b.Origin
+}
+
+// testOrdering has writers log concurrently and checks the log kept each
+// writer's calls in order, under increasing sequences, with batches in one
+// piece, and that subscribers saw the same order.
+func testOrdering(t *testing.T, open func() logger.Logger) {
+	const (
+		writers = 8
+		calls   = 25
+		// Every batchEvery'th call is a batch of batchSize events.
+		batchEvery = 5
+		batchSize  = 3
+	)
+
+	l, _, base := start(t, open)
+
+	total := writers * (calls + (calls/batchEvery)*(batchSize-1))
+
+	live, cancel := l.Subscribe()
+	defer cancel()
+
+	seen := make(chan []store.Event, 1)
+	go func() {
+		var got []store.Event
+		deadline := time.After(timeout)
+		for len(got) < total {
+			select {
+			case e, ok := <-live:
+				if !ok {
+					seen <- got
+					return
+				}
+				got = append(got, e)
+			case <-deadline:
+				seen <- got
+				return
+			}
+		}
+		seen <- got
+	}()
+
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			key := fmt.Sprintf("writer-%d", w)
+			for c := range calls {
+				var err error
+				if c%batchEvery == 0 {
+					var batch []store.Event
+					for i := range batchSize {
+						batch = append(batch, store.Event{
+							EventType: store.EventPut,
+							Key:       key,
+							Value:     []byte(fmt.Sprintf("%03d.%d", c, i)),
+						})
+					}
+					err = l.LogBatch(batch)
+				} else {
+					err = l.LogPut(key, []byte(fmt.Sprintf("%03d.0", c)), "", time.Time{})
+				}
+				if err != nil {
+					t.Errorf("writer %d call %d: %v", w, c, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	l, all, _ := start(t, open)
+	defer l.Close()
+
+	got := after(all, base)
+	if len(got) != total {
+		t.Fatalf("replayed %d events, logged %d", len(got), total)
+	}
+
+	last := make(map[string]string)
+	for i, e := range got {
+		if i > 0 && e.Sequence <= got[i-1].Sequence {
+			t.Fatalf("sequence %d follows %d", e.Sequence, got[i-1].Sequence)
+		}
+
+		if v := string(e.Value); v <= last[e.Key] {
+			t.Fatalf("%s logged %s after %s", e.Key, v, last[e.Key])
+		}
+		last[e.Key] = string(e.Value)
+
+		// A batch starts with .0 and has to be followed by the rest of it.
+		var c, n int
+		if _, err := fmt.Sscanf(string(e.Value), "%d.%d", &c, &n); err != nil {
+			t.Fatalf("unexpected value %q", e.Value)
+		}
+		if c%batchEvery == 0 && n == 0 {
+			if i+batchSize > len(got) {
+				t.Fatalf("batch %s %d cut short", e.Key, c)
+			}
+			for j := 1; j < batchSize; j++ {
+				want := fmt.Sprintf("%03d.%d", c, j)
+				if next := got[i+j]; next.Key != e.Key || string(next.Value) != want {
+					t.Fatalf("batch %s %d interleaved with %s %s", e.Key, c, next.Key, next.Value)
+				}
+			}
+		}
+	}
+
+	// A subscriber that falls behind is dropped, so it may only have seen the
+	// start of the log, but that in the same order.
+	saw := <-seen
+	if len(saw) == 0 {
+		t.Fatal("subscriber saw no events")
+	}
+	for i, e := range saw {
+		if e.Sequence != got[i].Sequence || !sameEvent(e, got[i]) {
+			t.Fatalf("subscriber saw %+v where the log has %+v", e, got[i])
+		}
+	}
+}
+
+// testReplay checks events come back from a reopened log exactly as they
+// were logged, and that sequences carry on after them.
+func testReplay(t *testing.T, open func() logger.Logger) {
+	expires := time.Unix(4102444800, 0)
+
+	wrote := []store.Event{
+		{EventType: store.EventPut, Key: "plain", Value: []byte("value")},
+		{
+			EventType:   store.EventPut,
+			Key:         "binary",
+			Value:       []byte{0, '\n', '\t', 0xff, '_', ' '},
+			ContentType: "application/octet-stream",
+			Expires:     expires,
+		},
+		{EventType: store.EventPut, Key: "a key_with\tspaces and\nlines", Value: []byte("under_score")},
+		{EventType: store.EventDelete, Key: "plain"},
+		{
+			EventType: store.EventPut,
+			Key:       "batch-1",
+			Value:     []byte("1"),
+			Version:   7,
+			Origin:    store.Origin{Frontend: "REST", Principal: "CN=alice", RequestID: "req-1"},
+		},
+		{EventType: store.EventDelete, Key: "batch-1", Version: 8, Origin: store.Origin{Frontend: "GRPC", RequestID: "req-2"}},
+		{EventType: store.EventPut, Key: "empty", Value: []byte{}},
+	}
+
+	l, _, base := start(t, open)
+
+	for _, e := range wrote[:3] {
+		if err := l.LogPut(e.Key, e.Value, e.ContentType, e.Expires); err != nil {
+			t.Fatalf("LogPut: %v", err)
+		}
+	}
+	if err := l.LogDelete(wrote[3].Key); err != nil {
+		t.Fatalf("LogDelete: %v", err)
+	}
+	if err := l.LogBatch(wrote[4:6]); err != nil {
+		t.Fatalf("LogBatch: %v", err)
+	}
+	if err := l.LogPut(wrote[6].Key, wrote[6].Value, "", time.Time{}); err != nil {
+		t.Fatalf("LogPut: %v", err)
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	l, all, _ := start(t, open)
+
+	got := after(all, base)
+	if len(got) != len(wrote) {
+		t.Fatalf("replayed %d events, logged %d", len(got), len(wrote))
+	}
+	for i := range wrote {
+		if !sameEvent(got[i], wrote[i]) {
+			t.Errorf("replayed %+v, logged %+v", got[i], wrote[i])
+		}
+		if got[i].Timestamp.IsZero() {
+			t.Errorf("replayed %+v without the time it was logged", got[i])
+		}
+	}
+
+	from, err := collect(l.ReadEventsFrom(got[3].Sequence))
+	if err != nil {
+		t.Fatalf("ReadEventsFrom: %v", err)
+	}
+	if len(from) != len(got)-3 || from[0].Sequence != got[3].Sequence {
+		t.Errorf("ReadEventsFrom(%d) returned %d events, want %d", got[3].Sequence, len(from), len(got)-3)
+	}
+
+	more := persisted(t, l, 1, func() {
+		if err := l.LogPut("more", []byte("after reopening"), "", time.Time{}); err != nil {
+			t.Fatalf("LogPut: %v", err)
+		}
+	})
+	if more[0].Sequence <= got[len(got)-1].Sequence {
+		t.Errorf("sequence %d reused after reopening, the log was at %d", more[0].Sequence, got[len(got)-1].Sequence)
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+// testErr checks Err is there to be watched once the logger runs and stays
+// quiet, like Health, while nothing goes wrong.
+func testErr(t *testing.T, open func() logger.Logger) {
+	l, _, _ := start(t, open)
+	defer l.Close()
+
+	errs := l.Err()
+	if errs == nil {
+		t.Fatal("Err returned a nil channel")
+	}
+
+	persisted(t, l, 2, func() {
+		_ = l.LogPut("err", []byte("1"), "", time.Time{})
+		_ = l.LogDelete("err")
+	})
+
+	select {
+	case err := <-errs:
+		t.Errorf("unexpected error: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := l.Health(); err != nil {
+		t.Errorf("unexpected health: %v", err)
+	}
+}
+
+// Breaker is implemented by loggers whose backing store tests can break,
+// making every write to it fail from then on, as a full disk or a lost
+// database would. Loggers that aren't skip the failure test.
+type Breaker interface {
+	Break()
+}
+
+// testFailure breaks the log under the logger and checks the write that
+// fails shows up on Err and in Health.
+func testFailure(t *testing.T, open func() logger.Logger) {
+	l, _, _ := start(t, open)
+	defer l.Close()
+
+	b, ok := l.(Breaker)
+	if !ok {
+		t.Skip("the logger can't be broken")
+	}
+	b.Break()
+
+	// Loggers that aren't durable may take the call before it fails.
+	_ = l.LogPut("failure", []byte("1"), "", time.Time{})
+
+	select {
+	case err := <-l.Err():
+		if err == nil {
+			t.Error("Err reported a nil error")
+		}
+	case <-time.After(timeout):
+		t.Fatal("the failed write wasn't reported on Err")
+	}
+
+	if err := l.Health(); !errors.Is(err, logger.ErrDegraded) {
+		t.Errorf("Health returned %v, want %v", err, logger.ErrDegraded)
+	}
+}
+
+// testClose checks Close persists whatever was logged before it and that
+// later calls fail.
+func testClose(t *testing.T, open func() logger.Logger) {
+	const n = 100
+
+	l, _, base := start(t, open)
+
+	for i := range n {
+		if err := l.LogPut("close", []byte(fmt.Sprintf("%03d", i)), "", time.Time{}); err != nil {
+			t.Fatalf("LogPut: %v", err)
+		}
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if err := l.LogPut("close", []byte("late"), "", time.Time{}); !errors.Is(err, logger.ErrClosed) {
+		t.Errorf("LogPut after Close returned %v, want %v", err, logger.ErrClosed)
+	}
+	if err := l.LogDelete("close"); !errors.Is(err, logger.ErrClosed) {
+		t.Errorf("LogDelete after Close returned %v, want %v", err, logger.ErrClosed)
+	}
+
+	// Closing again may fail, but mustn't panic.
+	_ = l.Close()
+
+	l, all, _ := start(t, open)
+	defer l.Close()
+
+	got := after(all, base)
+	if len(got) != n {
+		t.Fatalf("replayed %d events, logged %d before Close", len(got), n)
+	}
+	for i, e := range got {
+		if want := fmt.Sprintf("%03d", i); string(e.Value) != want {
+			t.Fatalf("event %d is %q, want %q", i, e.Value, want)
+		}
+	}
+}
+
+// testCompact checks a snapshot replaces the events it covers.
+func testCompact(t *testing.T, open func() logger.Logger) {
+	const n = 10
+
+	l, _, _ := start(t, open)
+
+	logged := persisted(t, l, n, func() {
+		for i := range n {
+			if err := l.LogPut(fmt.Sprintf("compact-%d", i), []byte{byte(i)}, "text/plain", time.Time{}); err != nil {
+				t.Fatalf("LogPut: %v", err)
+			}
+		}
+	})
+
+	covered := logged[n/2-1].Sequence
+
+	snap := store.Snapshot{Sequence: covered, Rev: n / 2}
+	for i, e := range logged[:n/2] {
+		snap.Entries = append(snap.Entries, store.KeyValue{
+			Key:         e.Key,
+			Value:       e.Value,
+			ContentType: e.ContentType,
+			Version:     uint64(i + 1),
+		})
+	}
+
+	if err := l.Compact(snap); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+
+	check := func(l logger.Logger) {
+		t.Helper()
+
+		got, err := l.LoadSnapshot()
+		if err != nil {
+			t.Fatalf("LoadSnapshot: %v", err)
+		}
+		if got == nil || got.Sequence != snap.Sequence || got.Rev != snap.Rev || len(got.Entries) != len(snap.Entries) {
+			t.Fatalf("LoadSnapshot returned %+v, want %+v", got, snap)
+		}
+		for i, kv := range got.Entries {
+			want := snap.Entries[i]
+			if kv.Key != want.Key || !bytes.Equal(kv.Value, want.Value) ||
+				kv.ContentType != want.ContentType || kv.Version != want.Version || !kv.Expires.Equal(want.Expires) {
+				t.Fatalf("snapshot entry %+v, want %+v", kv, want)
+			}
+		}
+
+		if _, err := collect(l.ReadEventsFrom(covered)); !errors.Is(err, logger.ErrCompacted) {
+			t.Errorf("ReadEventsFrom(%d) returned %v, want %v", covered, err, logger.ErrCompacted)
+		}
+
+		rest, err := collect(l.ReadEventsFrom(covered + 1))
+		if err != nil {
+			t.Fatalf("ReadEventsFrom: %v", err)
+		}
+		if len(rest) != n/2 || rest[0].Sequence != logged[n/2].Sequence {
+			t.Errorf("ReadEventsFrom(%d) returned %d events, want %d", covered+1, len(rest), n/2)
+		}
+	}
+
+	check(l)
+
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Events the snapshot covers may linger in the log until it gets around
+	// to dropping them, replay skips those.
+	l, all, _ := start(t, open)
+	defer l.Close()
+
+	check(l)
+
+	if got := after(all, covered); len(got) != n/2 || !sameEvent(got[0], logged[n/2]) {
+		t.Errorf("replayed %d events after the snapshot, want %d", len(got), n/2)
+	}
+
+	more := persisted(t, l, 1, func() {
+		if err := l.LogPut("compact-more", []byte("1"), "", time.Time{}); err != nil {
+			t.Fatalf("LogPut: %v", err)
+		}
+	})
+	if more[0].Sequence <= logged[n-1].Sequence {
+		t.Errorf("sequence %d reused after compacting, the log was at %d", more[0].Sequence, logged[n-1].Sequence)
+	}
+}
+
+// testHistory checks History pages through one key's events in order and
+// filters them by time.
+func testHistory(t *testing.T, open func() logger.Logger) {
+	l, _, base := start(t, open)
+	defer l.Close()
+
+	// Logs may be shared between runs, so the key is new each time.
+	key := fmt.Sprintf("history-%d", time.Now().UnixNano())
+	epoch := time.Now().Truncate(time.Second).Add(-time.Hour)
+
+	var wrote []store.Event
+	for i := range 5 {
+		wrote = append(wrote,
+			store.Event{
+				EventType: store.EventPut,
+				Key:       key,
+				Value:     []byte{byte('0' + i)},
+				Timestamp: epoch.Add(time.Duration(i) * time.Minute),
+				Origin:    store.Origin{Frontend: "REST", RequestID: fmt.Sprint(i)},
+			},
+			store.Event{EventType: store.EventPut, Key: key + "-other", Value: []byte("x")},
+		)
+	}
+
+	persisted(t, l, len(wrote), func() {
+		if err := l.LogBatch(wrote); err != nil {
+			t.Fatalf("LogBatch: %v", err)
+		}
+	})
+
+	var got []store.Event
+	q := logger.HistoryQuery{Key: key, After: base, Limit: 2}
+	for pages := 1; ; pages++ {
+		page, more, err := logger.History(l, q)
+		if err != nil {
+			t.Fatalf("History: %v", err)
+		}
+		if len(page) > q.Limit || (more && len(page) < q.Limit) {
+			t.Fatalf("page %d has %d events, more %v", pages, len(page), more)
+		}
+		got = append(got, page...)
+		if !more {
+			break
+		}
+		q.After = page[len(page)-1].Sequence
+	}
+
+	if len(got) != 5 {
+		t.Fatalf("History returned %d events, want 5", len(got))
+	}
+	for i, e := range got {
+		if !sameEvent(e, wrote[2*i]) || !e.Timestamp.Equal(wrote[2*i].Timestamp) {
+			t.Errorf("History returned %+v, logged %+v", e, wrote[2*i])
+		}
+		if i > 0 && e.Sequence <= got[i-1].Sequence {
+			t.Errorf("History returned sequence %d after %d", e.Sequence, got[i-1].Sequence)
+		}
+	}
+
+	filtered, more, err := logger.History(l, logger.HistoryQuery{
+		Key:   key,
+		After: base,
+		Since: epoch.Add(time.Minute),
+		Until: epoch.Add(3 * time.Minute),
+		Limit: 10,
+	})
+	if err != nil {
+		t.Fatalf("History: %v", err)
+	}
+	if more || len(filtered) != 2 || string(filtered[0].Value) != "1" || string(filtered[1].Value) != "2" {
+		t.Errorf("History between minutes 1 and 3 returned %+v, more %v", filtered, more)
+	}
+}
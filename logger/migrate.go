@@ -0,0 +1,117 @@
+package logger
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Migrations live in migrations/ as <version>_<name>.sql and are applied in
+// version order, each exactly once. Never edit one that has shipped, add a new
+// one instead. The first ones rebuild the schema the logger used to create by
+// hand, so they are written to be harmless on databases from back then.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLock is the advisory lock key that keeps instances starting at the
+// same time from racing through the migrations.
+const migrationLock = 0x636b766d // "ckvm"
+
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+func loadMigrations() ([]migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []migration
+	for _, entry := range entries {
+		base := strings.TrimSuffix(entry.Name(), ".sql")
+		num, name, _ := strings.Cut(base, "_")
+
+		version, err := strconv.Atoi(num)
+		if err != nil || version < 1 {
+			return nil, fmt.Errorf("migration %s has no version", entry.Name())
+		}
+
+		b, err := migrationFiles.ReadFile(path.Join("migrations", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		migrations = append(migrations, migration{version: version, name: name, sql: string(b)})
+	}
+
+	slices.SortFunc(migrations, func(a, b migration) int { return a.version - b.version })
+
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].version == migrations[i-1].version {
+			return nil, fmt.Errorf("duplicate migration version %d", migrations[i].version)
+		}
+	}
+
+	return migrations, nil
+}
+
+// migrate applies every migration db hasn't seen yet, all in one transaction,
+// and records them in schema_migrations.
+func migrate(db *sql.DB) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err := tx.Exec(`select pg_advisory_xact_lock($1)`, migrationLock); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`
+create table if not exists schema_migrations (
+  version int primary key,
+  name text not null,
+  applied_at timestamptz not null default now()
+)
+`); err != nil {
+		return err
+	}
+
+	var current int
+	if err := tx.QueryRow(`select coalesce(max(version), 0) from schema_migrations`).Scan(&current); err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		if _, err := tx.Exec(m.sql); err != nil {
+			return fmt.Errorf("migration %d %s: %w", m.version, m.name, err)
+		}
+
+		if _, err := tx.Exec(
+			`insert into schema_migrations (version, name) values ($1, $2)`,
+			m.version, m.name,
+		); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
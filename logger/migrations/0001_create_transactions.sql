@@ -0,0 +1,6 @@
+create table if not exists transactions (
+  sequence serial primary key,
+  event_type int,
+  key text,
+  value text
+);
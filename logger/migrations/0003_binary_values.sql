@@ -0,0 +1,9 @@
+-- Values used to be stored as text, which can't hold arbitrary bytes.
+do $$
+begin
+  if (select data_type from information_schema.columns
+      where table_name = 'transactions' and column_name = 'value') = 'text' then
+    alter table transactions alter column value type bytea using convert_to(value, 'UTF8');
+  end if;
+end
+$$;
@@ -0,0 +1,5 @@
+create table if not exists snapshots (
+  sequence bigint primary key,
+  taken timestamptz not null default now(),
+  data bytea not null
+);
@@ -0,0 +1 @@
+alter table transactions add column if not exists logged_at timestamptz;
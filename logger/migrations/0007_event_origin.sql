@@ -0,0 +1,3 @@
+alter table transactions add column if not exists frontend text;
+alter table transactions add column if not exists principal text;
+alter table transactions add column if not exists request_id text;
@@ -0,0 +1 @@
+create index if not exists transactions_key_sequence on transactions (key, sequence);
@@ -0,0 +1 @@
+alter table transactions add column if not exists version bigint;
@@ -0,0 +1,136 @@
+package logger
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/linkinlog/cloudKV/store"
+)
+
+// A file log is a run of segment files next to each other, each named after
+// the first sequence it holds, for example data.00000000000000000001.seg.
+// Every segment starts with fileHeader and holds whole records, only the last
+// one is ever appended to. Sorted by name the segments double as an index of
+// their starting sequences.
+const (
+	segmentSuffix = ".seg"
+
+	// DefaultSegmentSize is where segments roll over unless FileOptions says otherwise.
+	DefaultSegmentSize = 64 << 20
+)
+
+type segment struct {
+	// start is the sequence of the segment's first event, or of the next
+	// event logged if the segment is still empty.
+	start store.Sequence
+	name  string
+}
+
+func segmentName(filename string, start store.Sequence) string {
+	return fmt.Sprintf("%s.%020d%s", filename, start, segmentSuffix)
+}
+
+// listSegments returns the segments of the log at filename, ordered by start.
+func listSegments(filename string) ([]segment, error) {
+	names, err := filepath.Glob(filename + ".*" + segmentSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []segment
+	for _, name := range names {
+		num := strings.TrimSuffix(strings.TrimPrefix(name, filename+"."), segmentSuffix)
+		start, err := strconv.ParseUint(num, 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment{start: store.Sequence(start), name: name})
+	}
+
+	slices.SortFunc(segments, func(a, b segment) int {
+		return cmp.Compare(a.start, b.start)
+	})
+
+	return segments, nil
+}
+
+// findSegment returns the index of the segment holding from, which is the
+// last one starting at or before it.
+func findSegment(segments []segment, from store.Sequence) int {
+	i, _ := slices.BinarySearchFunc(segments, from+1, func(s segment, t store.Sequence) int {
+		return cmp.Compare(s.start, t)
+	})
+	return max(i-1, 0)
+}
+
+// splitSingleFile turns a log from before segments existed into the first
+// segment, upgrading its format on the way. next is the sequence to name it
+// after if the log turns out to be empty.
+func splitSingleFile(filename string, next store.Sequence) error {
+	info, err := os.Stat(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a transaction log", filename)
+	}
+
+	if err := upgradeFile(filename); err != nil {
+		return err
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	if version, err := readVersion(r); err == nil {
+		events, _, err := readRecord(r, version)
+		if err == nil && len(events) > 0 {
+			next = events[0].Sequence
+		} else if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+	} else if !errors.Is(err, errTruncatedHeader) {
+		return err
+	}
+
+	return os.Rename(filename, segmentName(filename, next))
+}
+
+// Duration is a time.Duration that reads and writes JSON as a string like "1h".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+
+	return nil
+}
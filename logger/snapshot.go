@@ -0,0 +1,183 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"gitlab.com/linkinlog/cloudKV/store"
+)
+
+// A snapshot is snapshotHeader followed by a single checksummed frame, framed
+// like a file log record:
+//
+//	uint32  payload length, big endian
+//	uint32  CRC-32C of the payload, big endian
+//	payload:
+//	  uvarint sequence covered, uvarint store revision,
+//	  varint  time the last event covered was logged in unix nanoseconds,
+//	          0 if unknown (not in version 1 snapshots)
+//	  uvarint entry count, then for every entry
+//	  uvarint version
+//	  varint  expiry in unix nanoseconds, 0 for none
+//	  key, value and content type, each as a uvarint length and the raw bytes
+//
+// The file logger keeps it in a file next to the log, Postgres in a bytea.
+const (
+	snapshotMagic   = "ckvsnap"
+	snapshotVersion = 2
+)
+
+var snapshotHeader = []byte{'c', 'k', 'v', 's', 'n', 'a', 'p', snapshotVersion}
+
+// ErrCompacted is returned when asked for events that were folded into a
+// snapshot and dropped from the log.
+var ErrCompacted = errors.New("events were compacted away")
+
+func encodeSnapshot(s store.Snapshot) []byte {
+	buf := append([]byte{}, snapshotHeader...)
+	buf = append(buf, 0, 0, 0, 0, 0, 0, 0, 0)
+
+	buf = binary.AppendUvarint(buf, uint64(s.Sequence))
+	buf = binary.AppendUvarint(buf, s.Rev)
+	buf = binary.AppendVarint(buf, toUnixNano(s.Time))
+	buf = binary.AppendUvarint(buf, uint64(len(s.Entries)))
+	for _, kv := range s.Entries {
+		buf = binary.AppendUvarint(buf, kv.Version)
+		buf = binary.AppendVarint(buf, toUnixNano(kv.Expires))
+		buf = appendBytes(buf, []byte(kv.Key))
+		buf = appendBytes(buf, kv.Value)
+		buf = appendBytes(buf, []byte(kv.ContentType))
+	}
+
+	frame := buf[len(snapshotHeader):]
+	payload := frame[8:]
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:], crc32.Checksum(payload, crcTable))
+
+	return buf
+}
+
+func decodeSnapshot(b []byte) (*store.Snapshot, error) {
+	version, err := readSnapshotVersion(b)
+	if err != nil {
+		return nil, err
+	}
+
+	frame := b[len(snapshotHeader):]
+	payload := frame[8:]
+	if int(binary.BigEndian.Uint32(frame)) != len(payload) {
+		return nil, errBadRecord
+	}
+	if binary.BigEndian.Uint32(frame[4:]) != crc32.Checksum(payload, crcTable) {
+		return nil, errChecksum
+	}
+
+	p := bytes.NewReader(payload)
+
+	seq, err := binary.ReadUvarint(p)
+	if err != nil {
+		return nil, errBadRecord
+	}
+	rev, err := binary.ReadUvarint(p)
+	if err != nil {
+		return nil, errBadRecord
+	}
+	var taken int64
+	if version > 1 {
+		if taken, err = binary.ReadVarint(p); err != nil {
+			return nil, errBadRecord
+		}
+	}
+	count, err := binary.ReadUvarint(p)
+	if err != nil || count > uint64(len(payload)) {
+		return nil, errBadRecord
+	}
+
+	s := &store.Snapshot{
+		Sequence: store.Sequence(seq),
+		Rev:      rev,
+		Time:     fromUnixNano(taken),
+		Entries:  make([]store.KeyValue, 0, count),
+	}
+
+	for range count {
+		var kv store.KeyValue
+
+		if kv.Version, err = binary.ReadUvarint(p); err != nil {
+			return nil, errBadRecord
+		}
+
+		expires, err := binary.ReadVarint(p)
+		if err != nil {
+			return nil, errBadRecord
+		}
+		kv.Expires = fromUnixNano(expires)
+
+		key, err := readBytes(p)
+		if err != nil {
+			return nil, err
+		}
+		kv.Key = string(key)
+
+		if kv.Value, err = readBytes(p); err != nil {
+			return nil, err
+		}
+
+		contentType, err := readBytes(p)
+		if err != nil {
+			return nil, err
+		}
+		kv.ContentType = string(contentType)
+
+		s.Entries = append(s.Entries, kv)
+	}
+
+	if p.Len() != 0 {
+		return nil, errBadRecord
+	}
+
+	return s, nil
+}
+
+// parseSnapshotSequence reads the sequence an encoded snapshot covers from
+// its first bytes, without checking the rest.
+func parseSnapshotSequence(b []byte) (store.Sequence, error) {
+	if _, err := readSnapshotVersion(b); err != nil {
+		return 0, err
+	}
+
+	seq, n := binary.Uvarint(b[len(snapshotHeader)+8:])
+	if n <= 0 {
+		return 0, errBadRecord
+	}
+
+	return store.Sequence(seq), nil
+}
+
+// readSnapshotVersion checks the header of an encoded snapshot and returns
+// its format version.
+func readSnapshotVersion(b []byte) (byte, error) {
+	if !bytes.HasPrefix(b, []byte(snapshotMagic)) || len(b) < len(snapshotHeader)+8 {
+		return 0, errors.New("malformed snapshot header")
+	}
+	v := b[len(snapshotMagic)]
+	if v < 1 || v > snapshotVersion {
+		return 0, fmt.Errorf("unsupported snapshot version %d", v)
+	}
+	return v, nil
+}
+
+// readFailed hands back err the way ReadEventsFrom reports failures.
+func readFailed(err error) (<-chan store.Event, <-chan error) {
+	outEvent := make(chan store.Event)
+	outError := make(chan error, 1)
+
+	outError <- err
+	close(outEvent)
+	close(outError)
+
+	return outEvent, outError
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"time"
 
 	"gitlab.com/linkinlog/cloudKV/env"
 	"gitlab.com/linkinlog/cloudKV/frontend"
+	"gitlab.com/linkinlog/cloudKV/history"
 	"gitlab.com/linkinlog/cloudKV/logger"
 )
 
@@ -38,6 +42,17 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate-log" {
+		if err := migrateLog(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "migrate-log:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	restoreTo := flag.String("restore-to", "", "restore the store to a log sequence or RFC 3339 time on startup")
+	flag.Parse()
+
 	opts := slog.HandlerOptions{AddSource: true, Level: slog.LevelInfo}
 	slogger := slog.New(slog.NewJSONHandler(os.Stdout, &opts))
 
@@ -47,7 +62,7 @@ func main() {
 	}
 
 	loggerType := logger.ToLoggerType(conf.Logger)
-	logger, err := logger.New(loggerType)
+	logger, err := logger.New(loggerType, conf.LoggerOptions())
 	if err != nil {
 		panic(err)
 	}
@@ -56,6 +71,14 @@ func main() {
 
 	slogger.Info("listening", "s.frontend", frontendType.String(), "s.logger", loggerType.String())
 	s := NewService(frontend, logger, slogger)
+	s.SetRetention(time.Duration(conf.Retention))
+	if *restoreTo != "" {
+		p, err := history.ParsePoint(*restoreTo)
+		if err != nil {
+			panic(err)
+		}
+		s.RestoreTo(p)
+	}
 	go s.Start()
 
 	errChan, cancel := watchFile(configPath, s, slogger)
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"gitlab.com/linkinlog/cloudKV/history"
+	"gitlab.com/linkinlog/cloudKV/logger"
+	"gitlab.com/linkinlog/cloudKV/store"
+)
+
+// migrateLog implements the migrate-log subcommand, which copies one
+// transaction log into another, snapshot and sequences included:
+//
+//	cloudkv migrate-log --from File --to PSQL [--dry-run]
+//
+// Both loggers are opened with the options in the config file. The service
+// must be stopped while it runs, and the log it writes to must be empty.
+// Once copied, both logs are replayed and the results compared.
+func migrateLog(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("migrate-log", flag.ContinueOnError)
+	from := flags.String("from", "", "logger to copy from: File, PSQL or Embedded")
+	to := flags.String("to", "", "logger to copy to: File, PSQL or Embedded")
+	dryRun := flags.Bool("dry-run", false, "check the source and target but write nothing")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	fromType, toType := logger.ToLoggerType(*from), logger.ToLoggerType(*to)
+	switch {
+	case fromType == 0:
+		return fmt.Errorf("unknown logger %q for --from", *from)
+	case toType == 0:
+		return fmt.Errorf("unknown logger %q for --to", *to)
+	case fromType == toType:
+		return errors.New("--from and --to name the same logger")
+	}
+
+	conf, err := GetConfig(configPath)
+	if errors.Is(err, os.ErrNotExist) {
+		conf, err = &defaultConfig, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	src, err := logger.New(fromType, conf.LoggerOptions())
+	if err != nil {
+		return fmt.Errorf("%s: %w", fromType, err)
+	}
+	defer src.Close()
+
+	dst, err := logger.New(toType, conf.LoggerOptions())
+	if err != nil {
+		return fmt.Errorf("%s: %w", toType, err)
+	}
+	defer dst.Close()
+
+	importer, ok := dst.(logger.Importer)
+	if !ok {
+		return fmt.Errorf("%s logs can't be migrated into", toType)
+	}
+
+	// Reading the whole target also tells file logs where they are up to.
+	snap, err := dst.LoadSnapshot()
+	if err != nil {
+		return fmt.Errorf("%s: %w", toType, err)
+	}
+	n, _, err := countEvents(dst, 0)
+	if err != nil {
+		return fmt.Errorf("%s: %w", toType, err)
+	}
+	if snap != nil || n > 0 {
+		return fmt.Errorf("the %s log isn't empty", toType)
+	}
+
+	if snap, err = src.LoadSnapshot(); err != nil {
+		return fmt.Errorf("%s: %w", fromType, err)
+	}
+	var after store.Sequence
+	if snap != nil {
+		after = snap.Sequence
+	}
+
+	want := store.New(false)
+	if _, err := history.Replay(src, want, history.Latest); err != nil {
+		return fmt.Errorf("%s: %w", fromType, err)
+	}
+
+	if *dryRun {
+		n, last, err := countEvents(src, after)
+		if err != nil {
+			return fmt.Errorf("%s: %w", fromType, err)
+		}
+
+		if snap != nil {
+			fmt.Fprintf(out, "would copy the snapshot at sequence %d\n", snap.Sequence)
+		}
+		fmt.Fprintf(out, "would copy %d events up to sequence %d from %s to %s, %d keys in all\n",
+			n, last, fromType, toType, len(want.Snapshot(0).Entries))
+		return nil
+	}
+
+	events, errs := src.ReadEvents()
+
+	// Events a snapshot covers can linger in the log, they aren't copied.
+	copied := make(chan store.Event)
+	var count int
+	go func() {
+		defer close(copied)
+		for e := range events {
+			if e.Sequence > after {
+				copied <- e
+				count++
+			}
+		}
+	}()
+
+	err = importer.Import(snap, copied)
+	for range copied {
+	}
+	if err := errors.Join(<-errs, err); err != nil {
+		return fmt.Errorf("failed to migrate from %s to %s: %w", fromType, toType, err)
+	}
+
+	got := store.New(false)
+	if _, err := history.Replay(dst, got, history.Latest); err != nil {
+		return fmt.Errorf("%s: %w", toType, err)
+	}
+
+	if err := compareStores(want.Snapshot(0), got.Snapshot(0)); err != nil {
+		return fmt.Errorf("the %s log doesn't replay the same as the %s log: %w", toType, fromType, err)
+	}
+
+	if snap != nil {
+		fmt.Fprintf(out, "copied the snapshot at sequence %d\n", snap.Sequence)
+	}
+	fmt.Fprintf(out, "copied %d events from %s to %s, both replay to the same %d keys\n",
+		count, fromType, toType, len(want.Snapshot(0).Entries))
+
+	return nil
+}
+
+// countEvents counts the events l holds after sequence after and returns
+// the last sequence among them.
+func countEvents(l logger.Logger, after store.Sequence) (n int, last store.Sequence, err error) {
+	events, errs := l.ReadEvents()
+	for e := range events {
+		if e.Sequence > after {
+			n++
+			last = e.Sequence
+		}
+	}
+	return n, last, <-errs
+}
+
+// compareStores returns an error describing the first difference between a
+// and b. Expiries only have to match to the microsecond, that is all
+// Postgres keeps.
+func compareStores(a, b store.Snapshot) error {
+	if a.Rev != b.Rev {
+		return fmt.Errorf("revision %d, want %d", b.Rev, a.Rev)
+	}
+
+	for i := range min(len(a.Entries), len(b.Entries)) {
+		want, got := a.Entries[i], b.Entries[i]
+
+		switch {
+		case got.Key != want.Key:
+			return fmt.Errorf("key %q, want %q", got.Key, want.Key)
+		case !bytes.Equal(got.Value, want.Value):
+			return fmt.Errorf("key %q has a different value", got.Key)
+		case got.ContentType != want.ContentType:
+			return fmt.Errorf("key %q has content type %q, want %q", got.Key, got.ContentType, want.ContentType)
+		case got.Version != want.Version:
+			return fmt.Errorf("key %q has version %d, want %d", got.Key, got.Version, want.Version)
+		case !got.Expires.Truncate(time.Microsecond).Equal(want.Expires.Truncate(time.Microsecond)):
+			return fmt.Errorf("key %q expires at %s, want %s", got.Key, got.Expires, want.Expires)
+		}
+	}
+
+	if len(a.Entries) != len(b.Entries) {
+		return fmt.Errorf("%d keys, want %d", len(b.Entries), len(a.Entries))
+	}
+
+	return nil
+}
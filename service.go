@@ -2,13 +2,16 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log/slog"
 	"os"
 	"runtime"
+	"time"
 
 	"gitlab.com/linkinlog/cloudKV/env"
 	ff "gitlab.com/linkinlog/cloudKV/featureflags"
 	"gitlab.com/linkinlog/cloudKV/frontend"
+	"gitlab.com/linkinlog/cloudKV/history"
 	"gitlab.com/linkinlog/cloudKV/logger"
 	"gitlab.com/linkinlog/cloudKV/store"
 	"go.opentelemetry.io/otel"
@@ -22,6 +25,12 @@ import (
 	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 )
 
+const (
+	reapInterval = time.Second
+	// compactInterval is how often the log is folded into a new snapshot.
+	compactInterval = 5 * time.Minute
+)
+
 func NewService(f frontend.Frontend, l logger.Logger, sl *slog.Logger) *Service {
 	return &Service{
 		frontend: f,
@@ -35,6 +44,12 @@ type Service struct {
 	logger   logger.Logger
 	slogger  *slog.Logger
 
+	// retention is how long events stay in the log before compaction folds
+	// them into the snapshot, and so how far back history can go.
+	retention time.Duration
+	// restoreTo, when set, is where the next Start restores the store to.
+	restoreTo *history.Point
+
 	cancel context.CancelFunc
 }
 
@@ -51,6 +66,7 @@ func (s *Service) Start() {
 
 	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(exporter))
 	defer func() { _ = provider.Shutdown(ctx) }()
+	otel.SetMeterProvider(provider)
 
 	meter := provider.Meter(env.ServiceName())
 
@@ -69,10 +85,25 @@ func (s *Service) Start() {
 	}
 
 	keyVal := store.New(telemetry)
-	if err := s.replay(keyVal); err != nil {
+	if _, err := history.Replay(s.logger, keyVal, history.Latest); err != nil {
 		panic(err)
 	}
 
+	if p := s.restoreTo; p != nil {
+		// Only once, a config reload restarts the service with what the
+		// restore left.
+		s.restoreTo = nil
+
+		n, err := history.Restore(s.logger, keyVal, *p, store.Origin{})
+		if err != nil {
+			panic(err)
+		}
+		s.slogger.Info("restored", "to", p.String(), "changed", n)
+	}
+
+	go keyVal.Reap(ctx, reapInterval)
+	go s.compactEvery(ctx, compactInterval)
+
 	frontendErrors := s.frontend.Start(keyVal)
 
 	for {
@@ -96,11 +127,14 @@ func (s *Service) Stop() {
 		s.cancel()
 	}
 
-	s.logger.Close()
-
+	// The frontend goes first so no writes race the logger draining.
 	if err := s.frontend.Close(context.Background()); err != nil {
 		s.slogger.Error("s.frontend.Close()", "error", err.Error())
 	}
+
+	if err := s.logger.Close(); err != nil {
+		s.slogger.Error("s.logger.Close()", "error", err.Error())
+	}
 }
 
 func (s *Service) SwitchFrontend(f frontend.Frontend) {
@@ -115,36 +149,59 @@ func (s *Service) SwitchLogger(l logger.Logger) {
 	}
 }
 
-func (s *Service) replay(kv *store.KeyValueStore) error {
-	events, errs := s.logger.ReadEvents()
+// SetRetention sets how long events are kept in the log, 0 compacts them
+// all.
+func (s *Service) SetRetention(d time.Duration) {
+	s.retention = d
+}
 
-	var (
-		ok  bool = true
-		e   store.Event
-		err error
-	)
+// RestoreTo makes the next Start restore the store to p once it has been
+// replayed.
+func (s *Service) RestoreTo(p history.Point) {
+	s.restoreTo = &p
+}
 
-	for ok && err == nil {
+// compactEvery runs compact every interval until ctx is cancelled.
+func (s *Service) compactEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
 		select {
-		case err, ok = <-errs:
-			if err != nil {
-				return err
-			}
-		case e, ok = <-events:
-			switch e.EventType {
-			case store.EventPut:
-				if err := kv.Put(e.Key, e.Value); err != nil {
-					return err
-				}
-			case store.EventDelete:
-				if err := kv.Delete(e.Key); err != nil {
-					return err
-				}
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.compact(); err != nil {
+				s.slogger.Error("s.compact()", "error", err)
 			}
 		}
 	}
+}
 
-	return nil
+// compact folds what was logged since the last snapshot into a new one,
+// leaving the events of the last retention period in the log. It replays into
+// a scratch store rather than copying the live one, so the snapshot matches
+// the log exactly and serving is never held up.
+func (s *Service) compact() error {
+	to := history.Latest
+	if s.retention > 0 {
+		to = history.Point{Time: time.Now().Add(-s.retention)}
+	}
+
+	kv := store.New(false)
+
+	last, err := history.Replay(s.logger, kv, to)
+	if errors.Is(err, logger.ErrCompacted) {
+		// The snapshot is newer than the cutoff, the clock must have gone back.
+		return nil
+	}
+	if err != nil || last.Sequence == 0 {
+		return err
+	}
+
+	next := kv.Snapshot(last.Sequence)
+	next.Time = last.Timestamp
+	return s.logger.Compact(next)
 }
 
 func setupTelemetry() (error, func(context.Context) error) {
@@ -1,10 +1,12 @@
 package store
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
-	"sync"
+	"sync/atomic"
+	"time"
 
 	"gitlab.com/linkinlog/cloudKV/env"
 	"go.opentelemetry.io/otel"
@@ -12,24 +14,91 @@ import (
 	"go.opentelemetry.io/otel/trace"
 )
 
-var ErrNoSuchKey = errors.New("no such key")
+var (
+	ErrNoSuchKey       = errors.New("no such key")
+	ErrVersionConflict = errors.New("version conflict")
+)
+
+type entry struct {
+	value       []byte
+	contentType string
+	expires     time.Time
+	// version is the store revision that last wrote the key.
+	version uint64
+}
 
+func (e entry) keyValue(key string) KeyValue {
+	return KeyValue{
+		Key:         key,
+		Value:       e.value,
+		ContentType: e.contentType,
+		Version:     e.version,
+		Expires:     e.expires,
+	}
+}
+
+func (e entry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// KeyValueStore splits its keys across shards, each with its own lock,
+// so readers never wait on each other and writers only contend per shard.
 type KeyValueStore struct {
-	lock      *sync.Mutex
-	m         map[string]string
+	shards []*shard
+	// rev is bumped by every mutation. Events are logged with the revision
+	// they took, which Apply restores.
+	rev       atomic.Uint64
 	telemetry bool
 }
 
 func New(telemetry bool) *KeyValueStore {
-	m := make(map[string]string)
-	lock := &sync.Mutex{}
+	return NewSharded(telemetry, DefaultShards)
+}
+
+func NewSharded(telemetry bool, shards int) *KeyValueStore {
+	return &KeyValueStore{shards: newShards(shards), telemetry: telemetry}
+}
+
+func (k *KeyValueStore) shard(key string) *shard {
+	return k.shards[shardIndex(key, len(k.shards))]
+}
+
+type PutOption func(*entry)
+
+// WithExpiry makes the key disappear at t. A zero t means the key never expires.
+func WithExpiry(t time.Time) PutOption {
+	return func(e *entry) {
+		e.expires = t
+	}
+}
 
-	return &KeyValueStore{lock: lock, m: m, telemetry: telemetry}
+// WithContentType records the media type of the value, so it can be served back as is.
+func WithContentType(contentType string) PutOption {
+	return func(e *entry) {
+		e.contentType = contentType
+	}
 }
 
-func (k *KeyValueStore) Put(key, value string) error {
-	k.lock.Lock()
-	defer k.lock.Unlock()
+// WithTTL makes the key disappear once ttl has passed. A ttl <= 0 means the key never expires.
+func WithTTL(ttl time.Duration) PutOption {
+	return func(e *entry) {
+		if ttl > 0 {
+			e.expires = time.Now().Add(ttl)
+		}
+	}
+}
+
+// Put keeps its own copy of value, so the caller is free to reuse it.
+// It returns the new version.
+func (k *KeyValueStore) Put(key string, value []byte, opts ...PutOption) (uint64, error) {
+	sh := k.shard(key)
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+
+	e := entry{value: bytes.Clone(value)}
+	for _, opt := range opts {
+		opt(&e)
+	}
 
 	var sp trace.Span
 	if k.telemetry {
@@ -38,22 +107,72 @@ func (k *KeyValueStore) Put(key, value string) error {
 		_, sp = tr.Start(context.Background(),
 			fmt.Sprintf("Put(%s, %s)", key, value),
 			trace.WithAttributes(attribute.String("key", key)),
-			trace.WithAttributes(attribute.String("value", value)),
+			trace.WithAttributes(attribute.String("value", string(value))),
+		)
+		defer sp.End()
+
+		if !e.expires.IsZero() {
+			sp.SetAttributes(attribute.String("expires", e.expires.Format(time.RFC3339Nano)))
+		}
+	}
+
+	e.version = k.rev.Add(1)
+	sh.m[key] = e
+
+	if k.telemetry && sp != nil {
+		sp.SetAttributes(attribute.Bool("success", true))
+	}
+	return e.version, nil
+}
+
+// CompareAndSwap sets key to value only if its current version is expected,
+// an expected version of 0 means the key must not exist yet.
+// It returns the new version, or ErrVersionConflict if the key moved on.
+func (k *KeyValueStore) CompareAndSwap(key string, expected uint64, value []byte, opts ...PutOption) (uint64, error) {
+	sh := k.shard(key)
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+
+	var sp trace.Span
+	if k.telemetry {
+		tr := otel.GetTracerProvider().Tracer(env.ServiceName())
+
+		_, sp = tr.Start(context.Background(),
+			fmt.Sprintf("CompareAndSwap(%s, %d, %s)", key, expected, value),
+			trace.WithAttributes(attribute.String("key", key)),
+			trace.WithAttributes(attribute.Int64("expected", int64(expected))),
+			trace.WithAttributes(attribute.String("value", string(value))),
 		)
 		defer sp.End()
 	}
 
-	k.m[key] = value
+	if current, _ := sh.get(key, time.Now()); current.version != expected {
+		if k.telemetry && sp != nil {
+			sp.SetAttributes(attribute.Bool("success", false))
+		}
+		return current.version, ErrVersionConflict
+	}
+
+	e := entry{value: bytes.Clone(value)}
+	for _, opt := range opts {
+		opt(&e)
+	}
+
+	e.version = k.rev.Add(1)
+	sh.m[key] = e
 
 	if k.telemetry && sp != nil {
 		sp.SetAttributes(attribute.Bool("success", true))
 	}
-	return nil
+	return e.version, nil
 }
 
-func (k *KeyValueStore) Delete(key string) error {
-	k.lock.Lock()
-	defer k.lock.Unlock()
+// Delete returns the revision the delete took, even if there was nothing
+// to delete.
+func (k *KeyValueStore) Delete(key string) (uint64, error) {
+	sh := k.shard(key)
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
 
 	var sp trace.Span
 	if k.telemetry {
@@ -66,18 +185,78 @@ func (k *KeyValueStore) Delete(key string) error {
 		defer sp.End()
 	}
 
-	delete(k.m, key)
+	version := k.rev.Add(1)
+	delete(sh.m, key)
 
 	if k.telemetry && sp != nil {
 		sp.SetAttributes(attribute.Bool("success", true))
 	}
 
-	return nil
+	return version, nil
+}
+
+// Apply makes the change a logged event records, under the version it was
+// logged with. Writes are logged after they are made, so concurrent ones can
+// be logged out of order: an event older than what the key holds is skipped,
+// and Apply reports whether it was applied. Either way the store revision
+// moves past the event's version. Events logged without a version take the
+// next revision, as they did when they were made.
+func (k *KeyValueStore) Apply(e Event) (bool, error) {
+	if e.EventType != EventPut && e.EventType != EventDelete {
+		return false, nil
+	}
+
+	sh := k.shard(e.Key)
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+
+	version := e.Version
+	if version == 0 {
+		version = k.rev.Add(1)
+	} else {
+		k.raiseRev(version)
+	}
+
+	if current, ok := sh.m[e.Key]; ok && current.version >= version {
+		return false, nil
+	}
+
+	switch e.EventType {
+	case EventPut:
+		sh.m[e.Key] = entry{
+			value:       bytes.Clone(e.Value),
+			contentType: e.ContentType,
+			expires:     e.Expires,
+			version:     version,
+		}
+	case EventDelete:
+		delete(sh.m, e.Key)
+	}
+
+	return true, nil
 }
 
-func (k *KeyValueStore) Get(key string) (string, error) {
-	k.lock.Lock()
-	defer k.lock.Unlock()
+// raiseRev moves rev up to at least v.
+func (k *KeyValueStore) raiseRev(v uint64) {
+	for {
+		rev := k.rev.Load()
+		if rev >= v || k.rev.CompareAndSwap(rev, v) {
+			return
+		}
+	}
+}
+
+// Get returns the value stored under key, the caller must not modify it.
+func (k *KeyValueStore) Get(key string) ([]byte, error) {
+	kv, err := k.Lookup(key)
+	return kv.Value, err
+}
+
+// Lookup is Get that also returns the content type, and the version to hand to CompareAndSwap.
+func (k *KeyValueStore) Lookup(key string) (KeyValue, error) {
+	sh := k.shard(key)
+	sh.lock.RLock()
+	defer sh.lock.RUnlock()
 
 	var sp trace.Span
 	if k.telemetry {
@@ -91,14 +270,37 @@ func (k *KeyValueStore) Get(key string) (string, error) {
 		defer sp.End()
 	}
 
-	value, ok := k.m[key]
+	e, ok := sh.get(key, time.Now())
 	if !ok {
-		return "", ErrNoSuchKey
+		return KeyValue{}, ErrNoSuchKey
 	}
 
 	if k.telemetry && sp != nil {
 		sp.SetAttributes(attribute.Bool("success", ok))
 	}
 
-	return value, nil
+	return e.keyValue(key), nil
+}
+
+// Reap removes expired keys every interval until ctx is cancelled.
+// Get already hides expired keys, this just keeps them from piling up.
+// Shards are reaped one at a time so the store is never locked as a whole.
+func (k *KeyValueStore) Reap(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			k.reap(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (k *KeyValueStore) reap(now time.Time) {
+	for _, sh := range k.shards {
+		sh.reap(now)
+	}
 }
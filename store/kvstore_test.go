@@ -0,0 +1,113 @@
+package store
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+const benchKeys = 1 << 12
+
+var benchValue = []byte("value")
+
+// shardCounts compares a single shard, which behaves like the old global
+// lock, against the sharded default.
+var shardCounts = []int{1, DefaultShards}
+
+func benchStore(b *testing.B, shards int) (*KeyValueStore, []string) {
+	b.Helper()
+
+	kv := NewSharded(false, shards)
+	keys := make([]string, benchKeys)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+		if _, err := kv.Put(keys[i], benchValue); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	return kv, keys
+}
+
+// benchParallel runs op from every GOMAXPROCS goroutine, writing on roughly
+// writePercent of the calls and reading on the rest.
+func benchParallel(b *testing.B, writePercent int) {
+	for _, n := range shardCounts {
+		b.Run(fmt.Sprintf("shards=%d", n), func(b *testing.B) {
+			kv, keys := benchStore(b, n)
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewSource(rand.Int63()))
+				for pb.Next() {
+					key := keys[r.Intn(len(keys))]
+					if r.Intn(100) < writePercent {
+						_, _ = kv.Put(key, benchValue)
+					} else {
+						_, _ = kv.Get(key)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkGetParallel(b *testing.B) {
+	benchParallel(b, 0)
+}
+
+func BenchmarkPutParallel(b *testing.B) {
+	benchParallel(b, 100)
+}
+
+func BenchmarkMixedParallel(b *testing.B) {
+	benchParallel(b, 10)
+}
+
+func TestScan(t *testing.T) {
+	kv := New(false)
+	var keys []string
+	for _, i := range rand.Perm(100) {
+		key := fmt.Sprintf("key-%02d", i)
+		keys = append(keys, key)
+		if _, err := kv.Put(key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	slices.Sort(keys)
+
+	for _, limit := range []int{0, 1, 7, 99, 100, 101} {
+		var got []string
+		start := "key-10"
+		for {
+			page, next := kv.Scan(start, "key-90", limit)
+			if limit > 0 && len(page) > limit {
+				t.Fatalf("limit %d: got a page of %d", limit, len(page))
+			}
+			for _, item := range page {
+				if string(item.Value) != item.Key {
+					t.Fatalf("limit %d: %s holds %q", limit, item.Key, item.Value)
+				}
+				got = append(got, item.Key)
+			}
+			if next == "" {
+				break
+			}
+			start = next
+		}
+
+		if want := keys[10:90]; !slices.Equal(got, want) {
+			t.Errorf("limit %d: got %v, want %v", limit, got, want)
+		}
+	}
+}
+
+func BenchmarkScan(b *testing.B) {
+	kv, _ := benchStore(b, DefaultShards)
+
+	b.ResetTimer()
+	for range b.N {
+		kv.Scan("", "", 10)
+	}
+}
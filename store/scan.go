@@ -0,0 +1,118 @@
+package store
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"gitlab.com/linkinlog/cloudKV/env"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type KeyValue struct {
+	Key         string
+	Value       []byte
+	ContentType string
+	Version     uint64
+	// Expires is zero for keys that never expire.
+	Expires time.Time
+}
+
+// Scan returns up to limit live keys in [start, end), ordered by key.
+// An empty end has no upper bound and a limit <= 0 has no limit.
+// next is the start of the following page, or empty once the range is exhausted.
+//
+// Shards are read one after another, so a scan racing with writers is not a
+// point-in-time view of the whole store.
+func (k *KeyValueStore) Scan(start, end string, limit int) (page []KeyValue, next string) {
+	var sp trace.Span
+	if k.telemetry {
+		tr := otel.GetTracerProvider().Tracer(env.ServiceName())
+
+		_, sp = tr.Start(context.Background(),
+			fmt.Sprintf("Scan(%s, %s, %d)", start, end, limit),
+			trace.WithAttributes(attribute.String("start", start)),
+			trace.WithAttributes(attribute.String("end", end)),
+			trace.WithAttributes(attribute.Int("limit", limit)),
+		)
+		defer sp.End()
+	}
+
+	// Only the limit+1 smallest keys are kept, the extra one is next.
+	var found scanHeap
+	now := time.Now()
+	for _, sh := range k.shards {
+		sh.lock.RLock()
+		for key, e := range sh.m {
+			if key < start || (end != "" && key >= end) || e.expired(now) {
+				continue
+			}
+			switch {
+			case limit <= 0:
+				found = append(found, e.keyValue(key))
+			case found.Len() <= limit:
+				heap.Push(&found, e.keyValue(key))
+			case key < found[0].Key:
+				found[0] = e.keyValue(key)
+				heap.Fix(&found, 0)
+			}
+		}
+		sh.lock.RUnlock()
+	}
+
+	page = found
+	slices.SortFunc(page, func(a, b KeyValue) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+
+	if limit > 0 && len(page) > limit {
+		next = page[limit].Key
+		page = page[:limit]
+	}
+
+	if k.telemetry && sp != nil {
+		sp.SetAttributes(attribute.Int("results", len(page)))
+	}
+
+	return page, next
+}
+
+// scanHeap keeps the largest key on top, so Scan can drop it for a smaller
+// one once it has found enough.
+type scanHeap []KeyValue
+
+func (h scanHeap) Len() int           { return len(h) }
+func (h scanHeap) Less(i, j int) bool { return h[i].Key > h[j].Key }
+func (h scanHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *scanHeap) Push(x any)        { *h = append(*h, x.(KeyValue)) }
+
+func (h *scanHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// ListPrefix is Scan over every key starting with prefix, resuming from
+// cursor when it is the next value of an earlier page.
+func (k *KeyValueStore) ListPrefix(prefix, cursor string, limit int) (page []KeyValue, next string) {
+	return k.Scan(max(prefix, cursor), PrefixEnd(prefix), limit)
+}
+
+// PrefixEnd returns the smallest key greater than every key with the given
+// prefix, or empty when there is no such key.
+func PrefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
@@ -0,0 +1,55 @@
+package store
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// DefaultShards is how many shards New splits the keyspace into.
+const DefaultShards = 64
+
+type shard struct {
+	lock sync.RWMutex
+	m    map[string]entry
+}
+
+func newShards(n int) []*shard {
+	if n < 1 {
+		n = 1
+	}
+
+	shards := make([]*shard, n)
+	for i := range shards {
+		shards[i] = &shard{m: make(map[string]entry)}
+	}
+
+	return shards
+}
+
+func shardIndex(key string, n int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
+
+// get returns the live entry for key. Expired entries are hidden but left for
+// the reaper, so this is safe under the read lock.
+func (s *shard) get(key string, now time.Time) (entry, bool) {
+	e, ok := s.m[key]
+	if !ok || e.expired(now) {
+		return entry{}, false
+	}
+	return e, true
+}
+
+func (s *shard) reap(now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for key, e := range s.m {
+		if e.expired(now) {
+			delete(s.m, key)
+		}
+	}
+}
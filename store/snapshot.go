@@ -0,0 +1,72 @@
+package store
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Snapshot is the state of a store once every event up to Sequence is applied.
+type Snapshot struct {
+	Sequence Sequence
+	// Rev is the store revision, so versions carry on where they left off
+	// once the snapshot is restored.
+	Rev uint64
+	// Time is when the last event the snapshot covers was logged, zero if
+	// that isn't known.
+	Time    time.Time
+	Entries []KeyValue
+}
+
+// Snapshot copies every live key, ordered by key, and tags the copy as
+// covering the log up to seq. Every shard is held for the copy, so it is a
+// point-in-time view of the whole store.
+func (k *KeyValueStore) Snapshot(seq Sequence) Snapshot {
+	for _, sh := range k.shards {
+		sh.lock.RLock()
+		defer sh.lock.RUnlock()
+	}
+
+	s := Snapshot{Sequence: seq, Rev: k.rev.Load()}
+
+	now := time.Now()
+	for _, sh := range k.shards {
+		for key, e := range sh.m {
+			if !e.expired(now) {
+				kv := e.keyValue(key)
+				kv.Value = bytes.Clone(kv.Value)
+				s.Entries = append(s.Entries, kv)
+			}
+		}
+	}
+
+	slices.SortFunc(s.Entries, func(a, b KeyValue) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+
+	return s
+}
+
+// Restore replaces everything in the store with the contents of s.
+func (k *KeyValueStore) Restore(s Snapshot) {
+	for _, sh := range k.shards {
+		sh.lock.Lock()
+		defer sh.lock.Unlock()
+	}
+
+	for _, sh := range k.shards {
+		clear(sh.m)
+	}
+
+	for _, kv := range s.Entries {
+		k.shard(kv.Key).m[kv.Key] = entry{
+			value:       bytes.Clone(kv.Value),
+			contentType: kv.ContentType,
+			expires:     kv.Expires,
+			version:     kv.Version,
+		}
+	}
+
+	k.rev.Store(s.Rev)
+}
@@ -0,0 +1,95 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"gitlab.com/linkinlog/cloudKV/env"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var ErrInvalidTxn = errors.New("invalid transaction")
+
+// Guard holds a transaction back unless Key is at Version, 0 meaning Key must not exist.
+type Guard struct {
+	Key     string
+	Version uint64
+}
+
+// Txn checks every guard and then applies ops in order, all while holding the
+// locks of every shard involved, so either every op is applied or none are.
+// Ops must be puts or deletes, their Sequence is ignored. Each op's Version
+// is set to the revision it took, so the ops can be logged as they are.
+// A failed guard returns ErrVersionConflict.
+func (k *KeyValueStore) Txn(guards []Guard, ops []Event) error {
+	var sp trace.Span
+	if k.telemetry {
+		tr := otel.GetTracerProvider().Tracer(env.ServiceName())
+
+		_, sp = tr.Start(context.Background(),
+			fmt.Sprintf("Txn(%d guards, %d ops)", len(guards), len(ops)),
+			trace.WithAttributes(attribute.Int("guards", len(guards))),
+			trace.WithAttributes(attribute.Int("ops", len(ops))),
+		)
+		defer sp.End()
+	}
+
+	var idx []int
+	for _, g := range guards {
+		idx = append(idx, shardIndex(g.Key, len(k.shards)))
+	}
+	for _, op := range ops {
+		if op.EventType != EventPut && op.EventType != EventDelete {
+			return fmt.Errorf("%w: unknown op %d on %q", ErrInvalidTxn, op.EventType, op.Key)
+		}
+		idx = append(idx, shardIndex(op.Key, len(k.shards)))
+	}
+
+	// Always lock in shard order so concurrent transactions can't deadlock.
+	slices.Sort(idx)
+	idx = slices.Compact(idx)
+	for _, i := range idx {
+		k.shards[i].lock.Lock()
+		defer k.shards[i].lock.Unlock()
+	}
+
+	now := time.Now()
+	for _, g := range guards {
+		if current, _ := k.shard(g.Key).get(g.Key, now); current.version != g.Version {
+			if k.telemetry && sp != nil {
+				sp.SetAttributes(attribute.Bool("success", false))
+			}
+			return fmt.Errorf("%w: %q is at version %d", ErrVersionConflict, g.Key, current.version)
+		}
+	}
+
+	for i, op := range ops {
+		sh := k.shard(op.Key)
+		version := k.rev.Add(1)
+		ops[i].Version = version
+
+		switch op.EventType {
+		case EventPut:
+			sh.m[op.Key] = entry{
+				value:       bytes.Clone(op.Value),
+				contentType: op.ContentType,
+				expires:     op.Expires,
+				version:     version,
+			}
+		case EventDelete:
+			delete(sh.m, op.Key)
+		}
+	}
+
+	if k.telemetry && sp != nil {
+		sp.SetAttributes(attribute.Bool("success", true))
+	}
+
+	return nil
+}
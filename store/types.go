@@ -1,5 +1,7 @@
 package store
 
+import "time"
+
 type Sequence uint64
 
 type EventType byte
@@ -11,7 +13,33 @@ const (
 )
 
 type Event struct {
-	Sequence   Sequence
-	EventType  EventType
-	Key, Value string
+	Sequence    Sequence
+	EventType   EventType
+	Key         string
+	Value       []byte
+	ContentType string
+	// Expires is zero for keys that never expire.
+	Expires time.Time
+	// Timestamp is when the event was logged, loggers set it if it is zero.
+	// Events logged before loggers kept it have none.
+	Timestamp time.Time
+	// Version is the store revision the event took, so replay hands out the
+	// versions clients saw. Events logged before loggers kept it have none.
+	Version uint64
+
+	Origin
+}
+
+// Origin records which request an event came from, so the log doubles as an
+// audit trail. Events logged before loggers kept it have none.
+type Origin struct {
+	// Frontend is the frontend that took the request, "REST" or "GRPC".
+	Frontend string
+	// Principal is who made the request, empty unless the client was
+	// authenticated: by a client certificate, or by a proxy trusted to name
+	// it in a header.
+	Principal string
+	// RequestID ties the event to the request, frontends hand it back to the
+	// client.
+	RequestID string
 }